@@ -0,0 +1,126 @@
+package appmon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// AccessLogFields are the names of the fields that an AccessLog can write, in
+// their default order. They are the Call fields plus DurationMS, the call's
+// duration in milliseconds.
+var AccessLogFields = []string{
+	"ID", "ParentCallID", "App", "Host", "RemoteAddr", "UserAgent", "User",
+	"URL", "HTTPMethod", "Route", "RouteParams", "QueryParams", "Tags",
+	"Start", "End", "DurationMS", "BodyLength", "HTTPStatusCode", "Err",
+}
+
+// accessLogField returns the value of the named field of c.
+func accessLogField(c *Call, field string) interface{} {
+	switch field {
+	case "ID":
+		return c.ID
+	case "ParentCallID":
+		return c.ParentCallID
+	case "App":
+		return c.App
+	case "Host":
+		return c.Host
+	case "RemoteAddr":
+		return c.RemoteAddr
+	case "UserAgent":
+		return c.UserAgent
+	case "User":
+		return c.User
+	case "URL":
+		return c.URL
+	case "HTTPMethod":
+		return c.HTTPMethod
+	case "Route":
+		return c.Route
+	case "RouteParams":
+		return c.RouteParams
+	case "QueryParams":
+		return c.QueryParams
+	case "Tags":
+		return c.Tags
+	case "Start":
+		return c.Start
+	case "End":
+		return c.End
+	case "DurationMS":
+		return float64(c.Duration()) / float64(time.Millisecond)
+	case "BodyLength":
+		return c.BodyLength
+	case "HTTPStatusCode":
+		return c.HTTPStatusCode
+	case "Err":
+		return c.Err
+	}
+	panic("unknown access log field " + field)
+}
+
+// AccessLog is an Observer that writes one JSON object per line for each
+// finished call, so that log pipelines can ingest calls without database
+// access. To log calls without storing them, leave DB nil.
+type AccessLog struct {
+	fields []string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLog returns an AccessLog that writes to w. Each line contains the
+// given fields (from AccessLogFields), in order; if no fields are given, all
+// of AccessLogFields are written.
+func NewAccessLog(w io.Writer, fields ...string) (*AccessLog, error) {
+	if len(fields) == 0 {
+		fields = AccessLogFields
+	}
+	for _, f := range fields {
+		if !isAccessLogField(f) {
+			return nil, fmt.Errorf("unknown access log field %q", f)
+		}
+	}
+	return &AccessLog{fields: fields, w: w}, nil
+}
+
+func isAccessLogField(f string) bool {
+	for _, f2 := range AccessLogFields {
+		if f == f2 {
+			return true
+		}
+	}
+	return false
+}
+
+// CallStarted implements Observer.
+func (l *AccessLog) CallStarted(c *Call) {}
+
+// CallFinished implements Observer.
+func (l *AccessLog) CallFinished(c *Call) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range l.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		v, err := json.Marshal(accessLogField(c, f))
+		if err != nil {
+			log.Printf("AccessLog: marshaling field %s of call ID %d failed: %s", f, c.ID, err)
+			v = []byte("null")
+		}
+		fmt.Fprintf(&buf, "%q:%s", f, v)
+	}
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(buf.Bytes()); err != nil {
+		log.Printf("AccessLog: write failed: %s", err)
+	}
+}
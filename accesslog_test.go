@@ -0,0 +1,90 @@
+package appmon
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewAccessLog(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := makeFinishedCall("api", "get-user", "GET", 200, 1500*time.Microsecond)
+	c.ID = 7
+	c.RouteParams = Params{"id": "123"}
+	l.CallFinished(c)
+	l.CallFinished(c)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, got %d: %q", len(lines), buf.String())
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(AccessLogFields) {
+		t.Errorf("want %d fields, got %d", len(AccessLogFields), len(m))
+	}
+	if m["ID"] != float64(7) || m["Route"] != "get-user" || m["DurationMS"] != 1.5 {
+		t.Errorf("bad fields: %v", m)
+	}
+	if id := m["RouteParams"].(map[string]interface{})["id"]; id != "123" {
+		t.Errorf("want RouteParams.id 123, got %v", id)
+	}
+}
+
+func TestAccessLog_Fields(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewAccessLog(&buf, "Route", "HTTPStatusCode", "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := makeFinishedCall("api", "get-user", "GET", 404, time.Millisecond)
+	l.CallFinished(c)
+
+	if want, got := `{"Route":"get-user","HTTPStatusCode":404,"ID":0}`+"\n", buf.String(); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if _, err := NewAccessLog(&buf, "Nope"); err == nil {
+		t.Error("want error for unknown field")
+	}
+}
+
+func TestAccessLog_WithoutDB(t *testing.T) {
+	origDB, origObservers := DB, Observers
+	defer func() { DB, Observers = origDB, origObservers }()
+
+	var buf bytes.Buffer
+	l, err := NewAccessLog(&buf, "ID", "App", "HTTPStatusCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB, Observers = nil, []Observer{l}
+
+	rt := mux.NewRouter()
+	rt.Path("/").Handler(TrackAPICall("my-app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["App"] != "my-app" || m["HTTPStatusCode"] != float64(http.StatusTeapot) {
+		t.Errorf("bad fields: %v", m)
+	}
+	if m["ID"] == float64(0) {
+		t.Error("want nonzero ID")
+	}
+}
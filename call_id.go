@@ -1,10 +1,11 @@
 package appmon
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"github.com/gorilla/context"
 	"log"
 	"net/http"
-	"strconv"
 )
 
 // ParentCallIDHeader is the HTTP request header ("X-Appmon-Parent-Call-ID")
@@ -23,12 +24,7 @@ func GetCallID(r *http.Request) (int64, bool) {
 // GetParentCallID gets the parent call ID (if any) of the current call from the
 // current HTTP request's headers.
 func GetParentCallID(r *http.Request) (int64, bool) {
-	v := r.Header.Get(ParentCallIDHeader)
-	if v == "" {
-		return 0, false
-	}
-	callID, err := strconv.ParseInt(v, 10, 64)
-	return callID, err == nil
+	return ExtractHeader(r.Header)
 }
 
 func AddParentCallIDHeader(parent *http.Request, h http.Header) {
@@ -37,13 +33,61 @@ func AddParentCallIDHeader(parent *http.Request, h http.Header) {
 		log.Printf("warning: AddParentCallIDHeader: no call ID")
 		return
 	}
-	addParentCallIDHeader(parentCallID, h)
-}
-
-func addParentCallIDHeader(parentCallID int64, h http.Header) {
-	h.Set(ParentCallIDHeader, strconv.FormatInt(parentCallID, 10))
+	InjectHeader(parentCallID, h)
 }
 
 func setCallID(r *http.Request, id int64) {
 	context.Set(r, callID, id)
 }
+
+// getCall gets the Call (if any) being tracked for the request.
+func getCall(r *http.Request) (*Call, bool) {
+	c, ok := context.Get(r, currentCall).(*Call)
+	return c, ok
+}
+
+func setCall(r *http.Request, c *Call) {
+	context.Set(r, currentCall, c)
+}
+
+// getMonitor gets the Monitor (if any) that tracks the call for the request.
+func getMonitor(r *http.Request) (*Monitor, bool) {
+	m, ok := context.Get(r, currentMonitor).(*Monitor)
+	return m, ok
+}
+
+func setMonitor(r *http.Request, m *Monitor) {
+	context.Set(r, currentMonitor, m)
+}
+
+// clearCall removes the Call and Monitor being tracked for the request from
+// its context (but keeps its call ID), so that they aren't retained after the
+// call finishes.
+func clearCall(r *http.Request) {
+	context.Delete(r, currentCall)
+	context.Delete(r, currentMonitor)
+}
+
+// setNotSampled records that r isn't tracked because it wasn't sampled.
+func setNotSampled(r *http.Request) {
+	context.Set(r, notSampled, true)
+}
+
+func isNotSampled(r *http.Request) bool {
+	v, _ := context.Get(r, notSampled).(bool)
+	return v
+}
+
+// newCallID returns a random positive call ID, for use when calls aren't
+// stored in the database (which would otherwise assign the ID).
+func newCallID() int64 {
+	for {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic("newCallID: " + err.Error())
+		}
+		if id := int64(binary.BigEndian.Uint64(b[:]) >> 1); id != 0 {
+			return id
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package appmon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CallIDLogKey is the key of the call ID in log entries written with the
+// loggers returned by Logger and LogHandler (e.g., "call_id=123"), so that a
+// call's log entries can be found by its ID.
+const CallIDLogKey = "call_id"
+
+// DefaultMaxLogLines is the default maximum number of log lines captured per
+// call (see LogCapture).
+const DefaultMaxLogLines = 100
+
+// LogCapture configures the capturing of calls' log lines by a Monitor. Lines
+// written with the call's loggers (see Logger and LogHandler) are buffered
+// while the call is handled, and stored with the call (in Call.Log) when it
+// finishes if it failed or was slow. Captured lines are scrubbed by the
+// Monitor's Scrubbers (e.g., a PIIScrubber replaces the sensitive values that
+// its Detectors find) before they are stored.
+type LogCapture struct {
+	// SlowThreshold is the duration after which a call is considered slow.
+	// If 0, only the log lines of failed calls are stored.
+	SlowThreshold time.Duration
+
+	// MaxLines is the maximum number of log lines buffered per call; later
+	// lines are only counted. If 0, DefaultMaxLogLines is used.
+	MaxLines int
+}
+
+// CaptureLogs, if set, configures capturing of the log lines of calls tracked
+// without a Monitor (see Monitor.LogCapture).
+var CaptureLogs *LogCapture
+
+func (lc *LogCapture) maxLines() int {
+	if lc.MaxLines > 0 {
+		return lc.MaxLines
+	}
+	return DefaultMaxLogLines
+}
+
+// keep returns whether the captured log lines of c, which finished with
+// status s, should be stored.
+func (lc *LogCapture) keep(c *Call, s *CallStatus) bool {
+	if s.Err != "" || s.HTTPStatusCode < 200 || s.HTTPStatusCode >= 400 {
+		return true
+	}
+	return lc.SlowThreshold > 0 && s.End.Time.Sub(c.Start) >= lc.SlowThreshold
+}
+
+// logBuffer holds the log lines captured for a call. Each Write is one log
+// entry.
+type logBuffer struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	dropped int
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.lines) < b.max {
+		b.lines = append(b.lines, strings.TrimSuffix(string(p), "\n"))
+	} else {
+		b.dropped++
+	}
+	return len(p), nil
+}
+
+// Lines returns the captured lines, followed by a line that reports the
+// number of lines that weren't captured (if any).
+func (b *logBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := append([]string(nil), b.lines...)
+	if b.dropped > 0 {
+		lines = append(lines, fmt.Sprintf("[%d more log lines not captured]", b.dropped))
+	}
+	return lines
+}
+
+// Logger returns a logger for the call being tracked for r that writes to
+// base, prefixing each entry with the call's ID (e.g., "call_id=123 "). If the
+// Monitor that tracks the call captures logs (see Monitor.LogCapture), the
+// entries are also captured for the call. If no call is being tracked for r,
+// base is returned.
+func Logger(r *http.Request, base *log.Logger) *log.Logger {
+	if c, ok := getCall(r); ok {
+		return c.Logger(base)
+	}
+	return base
+}
+
+// LogHandler returns a slog.Handler for the call being tracked for r that
+// passes records to h with the call's ID as the CallIDLogKey attribute. If
+// the Monitor that tracks the call captures logs (see Monitor.LogCapture),
+// the records are also captured for the call. If no call is being tracked for
+// r, h is returned.
+func LogHandler(r *http.Request, h slog.Handler) slog.Handler {
+	if c, ok := getCall(r); ok {
+		return c.LogHandler(h)
+	}
+	return h
+}
+
+// Logger returns a logger for the job's call. See Logger.
+func (j *Job) Logger(base *log.Logger) *log.Logger { return j.c.Logger(base) }
+
+// LogHandler returns a slog.Handler for the job's call. See LogHandler.
+func (j *Job) LogHandler(h slog.Handler) slog.Handler { return j.c.LogHandler(h) }
+
+// Logger returns a logger for c. It is for integrations that track calls with
+// Monitor.StartCall; applications should use the package-level Logger (or
+// Job.Logger) instead.
+func (c *Call) Logger(base *log.Logger) *log.Logger {
+	w := base.Writer()
+	if c.logs != nil {
+		w = io.MultiWriter(c.logs, w)
+	}
+	return log.New(w, base.Prefix()+CallIDLogKey+"="+strconv.FormatInt(c.ID, 10)+" ", base.Flags())
+}
+
+// LogHandler returns a slog.Handler for c. It is for integrations that track
+// calls with Monitor.StartCall; applications should use the package-level
+// LogHandler (or Job.LogHandler) instead.
+func (c *Call) LogHandler(h slog.Handler) slog.Handler {
+	idAttr := []slog.Attr{slog.Int64(CallIDLogKey, c.ID)}
+	lh := &logHandler{h: h.WithAttrs(idAttr)}
+	if c.logs != nil {
+		// h decides which records are enabled, so capture records of all
+		// levels.
+		lh.capture = slog.NewTextHandler(c.logs, &slog.HandlerOptions{Level: slog.Level(math.MinInt)}).WithAttrs(idAttr)
+	}
+	return lh
+}
+
+// logHandler is a slog.Handler that passes records to h and, if capture is
+// set, captures them for a call.
+type logHandler struct {
+	h       slog.Handler
+	capture slog.Handler
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.capture != nil {
+		h.capture.Handle(ctx, r.Clone())
+	}
+	return h.h.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := &logHandler{h: h.h.WithAttrs(attrs)}
+	if h.capture != nil {
+		h2.capture = h.capture.WithAttrs(attrs)
+	}
+	return h2
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	h2 := &logHandler{h: h.h.WithGroup(name)}
+	if h.capture != nil {
+		h2.capture = h.capture.WithGroup(name)
+	}
+	return h2
+}
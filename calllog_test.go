@@ -0,0 +1,151 @@
+package appmon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{Observers: []Observer{&obs}, Live: &Hub{}, LogCapture: &LogCapture{}}
+	var out bytes.Buffer
+	base := log.New(&out, "app: ", 0)
+
+	var callID int64
+	m.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callID, _ = GetCallID(r)
+		Logger(r, base).Printf("loading %d", 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	want := fmt.Sprintf("app: call_id=%d loading 1", callID)
+	if got := strings.TrimSpace(out.String()); got != want {
+		t.Errorf("got log output %q, want %q", got, want)
+	}
+	if len(obs.calls) != 1 {
+		t.Fatalf("got %d calls, want 1", len(obs.calls))
+	}
+	if got := obs.calls[0].Log; !reflect.DeepEqual(got, []string{want}) {
+		t.Errorf("got captured log %q, want %q", got, []string{want})
+	}
+
+	// Logger on an untracked request returns base.
+	if l := Logger(httptest.NewRequest("GET", "/", nil), base); l != base {
+		t.Error("want base logger for untracked request")
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{Observers: []Observer{&obs}, Live: &Hub{}, LogCapture: &LogCapture{}}
+	var out bytes.Buffer
+	base := slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo})
+
+	err := m.RunJob("job", 0, nil, func(j *Job) error {
+		l := slog.New(j.LogHandler(base)).With("user", "alice")
+		l.Debug("not logged")
+		l.Info("sending", "to", "bob")
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("want error")
+	}
+
+	c := obs.calls[0]
+	wantAttrs := fmt.Sprintf("msg=sending call_id=%d user=alice to=bob", c.ID)
+	if !strings.Contains(out.String(), wantAttrs) {
+		t.Errorf("got log output %q, want it to contain %q", out.String(), wantAttrs)
+	}
+	if len(c.Log) != 1 || !strings.Contains(c.Log[0], wantAttrs) {
+		t.Errorf("got captured log %q, want 1 line containing %q", c.Log, wantAttrs)
+	}
+}
+
+func TestLogCapture(t *testing.T) {
+	tests := map[string]struct {
+		capture   LogCapture
+		status    int
+		duration  time.Duration
+		wantLines []string
+	}{
+		"success":      {capture: LogCapture{}, status: 200, duration: time.Second},
+		"failed":       {capture: LogCapture{}, status: 500, wantLines: []string{"a", "b", "c"}},
+		"slow":         {capture: LogCapture{SlowThreshold: time.Second}, status: 200, duration: time.Second, wantLines: []string{"a", "b", "c"}},
+		"fast":         {capture: LogCapture{SlowThreshold: time.Second}, status: 200},
+		"max lines":    {capture: LogCapture{MaxLines: 2}, status: 500, wantLines: []string{"a", "b", "[1 more log lines not captured]"}},
+		"client error": {capture: LogCapture{}, status: 404, wantLines: []string{"a", "b", "c"}},
+	}
+	for label, test := range tests {
+		m := &Monitor{Live: &Hub{}, LogCapture: &test.capture}
+		c := &Call{}
+		m.StartCall(c)
+		l := c.Logger(log.New(&bytes.Buffer{}, "", 0))
+		for _, s := range []string{"a", "b", "c"} {
+			l.Print(s)
+		}
+		m.FinishCall(c, CallStatus{HTTPStatusCode: test.status, End: NullTime{c.Start.Add(test.duration), true}})
+
+		var got []string
+		for _, line := range c.Log {
+			got = append(got, strings.TrimPrefix(line, fmt.Sprintf("call_id=%d ", c.ID)))
+		}
+		if !reflect.DeepEqual(got, test.wantLines) {
+			t.Errorf("%s: got captured log %q, want %q", label, got, test.wantLines)
+		}
+	}
+}
+
+func TestLogCapture_Scrubbed(t *testing.T) {
+	s := NewPIIScrubber([]byte("k"))
+	m := &Monitor{Scrubbers: []Scrubber{s}, Live: &Hub{}, LogCapture: &LogCapture{}}
+	c := &Call{}
+	m.StartCall(c)
+	c.Logger(log.New(&bytes.Buffer{}, "", 0)).Print("emailing alice@example.com")
+	m.FinishCall(c, CallStatus{HTTPStatusCode: 500})
+
+	want := fmt.Sprintf("call_id=%d emailing %s", c.ID, s.hash("email", "alice@example.com"))
+	if !reflect.DeepEqual(c.Log, []string{want}) {
+		t.Errorf("got captured log %q, want %q", c.Log, []string{want})
+	}
+
+	// Call IDs that look like card numbers aren't scrubbed.
+	c = &Call{Log: []string{"call_id=4111111111111111 paying with 4111111111111111"}}
+	s.Scrub(c)
+	if want := "call_id=4111111111111111 paying with " + s.hash("card", "4111111111111111"); c.Log[0] != want {
+		t.Errorf("got scrubbed log line %q, want %q", c.Log[0], want)
+	}
+}
+
+func TestDefaultMonitor_CaptureLogs(t *testing.T) {
+	orig := CaptureLogs
+	defer func() { CaptureLogs = orig }()
+	CaptureLogs = &LogCapture{MaxLines: 10}
+	if m := DefaultMonitor("app"); m.LogCapture != CaptureLogs {
+		t.Errorf("got LogCapture %v, want %v", m.LogCapture, CaptureLogs)
+	}
+}
+
+func TestFinishCall_StoresLog(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	m := &Monitor{Store: defaultStore(), Live: &Hub{}, LogCapture: &LogCapture{}}
+	c := &Call{HTTPMethod: "GET", RouteParams: Params{}, QueryParams: Params{}}
+	m.StartCall(c)
+	c.Logger(log.New(&bytes.Buffer{}, "", 0)).Print("failing")
+	m.FinishCall(c, CallStatus{HTTPStatusCode: 500})
+
+	c2 := getOnlyOneCall(t)
+	if want := []string{fmt.Sprintf("call_id=%d failing", c.ID)}; !reflect.DeepEqual(c2.Log, want) {
+		t.Errorf("got log %q, want %q", c2.Log, want)
+	}
+}
@@ -0,0 +1,151 @@
+package appmon
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of the reverse proxies and load balancers
+// in front of the application. The client address of a request from a trusted
+// proxy is taken from the request's Forwarded, X-Forwarded-For or X-Real-IP
+// header instead of its RemoteAddr. If empty, these headers are ignored, since
+// any client can set them.
+var TrustedProxies []*net.IPNet
+
+// Limits on the forwarding chain recorded for a request, whose headers any
+// client can set.
+const (
+	maxForwardedHops = 20
+	maxHopLength     = 64
+)
+
+// TrustProxies parses the given CIDR networks (e.g., "10.0.0.0/8") and single
+// IP addresses and adds them to TrustedProxies.
+func TrustProxies(cidrs ...string) error {
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			TrustedProxies = append(TrustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy network %q: %s", s, err)
+		}
+		TrustedProxies = append(TrustedProxies, ipnet)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the IP address of the client that made r, and the chain
+// of addresses that r was forwarded through, from the original client to the
+// immediate peer (comma-separated). The chain is empty if r has no forwarding
+// headers. Only the maxForwardedHops hops nearest to the peer are kept (the
+// chain starts with "…" if more were dropped), and hops longer than
+// maxHopLength are truncated. Only forwarding headers added by the given
+// trusted proxies are used. If the client address can't be determined, addr
+// is empty.
+func clientAddr(r *http.Request, trusted []*net.IPNet) (addr, chain string) {
+	peer := parseAddr(r.RemoteAddr)
+
+	hops := forwardedHops(r.Header)
+	if len(hops) == 0 {
+		if realIP := r.Header.Get("X-Real-Ip"); realIP != "" {
+			hops = []string{strings.TrimSpace(realIP)}
+		}
+	}
+	if len(hops) == 0 {
+		return ipString(peer), ""
+	}
+	dropped := len(hops) > maxForwardedHops
+	if dropped {
+		hops = hops[len(hops)-maxForwardedHops:]
+	}
+	for i, h := range hops {
+		hops[i] = truncate("remote_addr_chain", h, maxHopLength)
+	}
+	chain = strings.Join(append(hops, r.RemoteAddr), ", ")
+	if dropped {
+		chain = "…, " + chain
+	}
+
+	// Walk the chain from the peer back toward the client, stopping at the
+	// first address not added by a trusted proxy.
+	client := peer
+	for i := len(hops) - 1; i >= 0 && isTrustedProxy(client, trusted); i-- {
+		ip := parseAddr(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip
+	}
+	return ipString(client), chain
+}
+
+// forwardedHops returns the addresses listed in the Forwarded header's "for"
+// parameters or, if there's no Forwarded header, the X-Forwarded-For header.
+// Multiple headers are treated as a single comma-separated list.
+func forwardedHops(h http.Header) (hops []string) {
+	if fwd := h["Forwarded"]; len(fwd) > 0 {
+		for _, elem := range strings.Split(strings.Join(fwd, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+		return
+	}
+	if xff := h["X-Forwarded-For"]; len(xff) > 0 {
+		for _, s := range strings.Split(strings.Join(xff, ","), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				hops = append(hops, s)
+			}
+		}
+	}
+	return
+}
+
+// parseAddr parses an IP address with an optional port, such as "1.2.3.4",
+// "1.2.3.4:5678", "::1" or "[::1]:5678". IPv6 zones are discarded. It returns
+// nil if s isn't an IP address.
+func parseAddr(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.Index(s, "%"); i != -1 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
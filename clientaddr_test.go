@@ -0,0 +1,84 @@
+package appmon
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	orig := TrustedProxies
+	defer func() { TrustedProxies = orig }()
+	TrustedProxies = nil
+	if err := TrustProxies("10.0.0.0/8", "fd00::1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		header     http.Header
+		wantAddr   string
+		wantChain  string
+	}{
+		{"1.2.3.4:5678", nil, "1.2.3.4", ""},
+		{"[2001:db8::1]:5678", nil, "2001:db8::1", ""},
+		{"[fe80::1%eth0]:5678", nil, "fe80::1", ""},
+		{"garbage", nil, "", ""},
+
+		// Untrusted peers can't spoof the client address.
+		{"1.2.3.4:5678", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "1.2.3.4", "5.6.7.8, 1.2.3.4:5678"},
+
+		{"10.0.0.1:5678", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "5.6.7.8", "5.6.7.8, 10.0.0.1:5678"},
+		{"10.0.0.1:5678", http.Header{"X-Forwarded-For": {"9.9.9.9, 5.6.7.8, 10.0.0.2"}}, "5.6.7.8", "9.9.9.9, 5.6.7.8, 10.0.0.2, 10.0.0.1:5678"},
+		{"10.0.0.1:5678", http.Header{"X-Forwarded-For": {"9.9.9.9", "5.6.7.8"}}, "5.6.7.8", "9.9.9.9, 5.6.7.8, 10.0.0.1:5678"},
+		{"[fd00::1]:5678", http.Header{"X-Forwarded-For": {"2001:db8::2"}}, "2001:db8::2", "2001:db8::2, [fd00::1]:5678"},
+		{"10.0.0.1:5678", http.Header{"X-Forwarded-For": {"unknown"}}, "10.0.0.1", "unknown, 10.0.0.1:5678"},
+		{"10.0.0.1:5678", http.Header{"X-Real-Ip": {"5.6.7.8"}}, "5.6.7.8", "5.6.7.8, 10.0.0.1:5678"},
+		{
+			"10.0.0.1:5678",
+			http.Header{"Forwarded": {`for=9.9.9.9;proto=https, For="[2001:db8::3]:1234"`}, "X-Forwarded-For": {"5.6.7.8"}},
+			"2001:db8::3",
+			"9.9.9.9, [2001:db8::3]:1234, 10.0.0.1:5678",
+		},
+	}
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.remoteAddr, Header: test.header}
+		addr, chain := clientAddr(r, TrustedProxies)
+		if addr != test.wantAddr {
+			t.Errorf("%s %v: want addr %q, got %q", test.remoteAddr, test.header, test.wantAddr, addr)
+		}
+		if chain != test.wantChain {
+			t.Errorf("%s %v: want chain %q, got %q", test.remoteAddr, test.header, test.wantChain, chain)
+		}
+	}
+}
+
+func TestClientAddr_LongChain(t *testing.T) {
+	hops := make([]string, 50)
+	for i := range hops {
+		hops[i] = "10.0.0.2"
+	}
+	hops[0] = strings.Repeat("x", 1000)
+	hops[len(hops)-1] = strings.Repeat("y", 1000)
+	r := &http.Request{RemoteAddr: "1.2.3.4:5678", Header: http.Header{"X-Forwarded-For": {strings.Join(hops, ",")}}}
+
+	_, chain := clientAddr(r, nil)
+	parts := strings.Split(chain, ", ")
+	if len(parts) != maxForwardedHops+2 || parts[0] != "…" || parts[len(parts)-1] != "1.2.3.4:5678" {
+		t.Errorf("got chain %q, want … followed by %d hops and the peer", chain, maxForwardedHops)
+	}
+	if n := len([]rune(parts[len(parts)-2])); n != maxHopLength {
+		t.Errorf("got last hop of %d characters, want %d", n, maxHopLength)
+	}
+}
+
+func TestTrustProxies_Invalid(t *testing.T) {
+	orig := TrustedProxies
+	defer func() { TrustedProxies = orig }()
+
+	for _, s := range []string{"foo", "10.0.0.0/33", ""} {
+		if err := TrustProxies(s); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Command appmon-privacy exports, deletes or anonymizes the stored calls of a
+// user, to honor privacy requests. Each operation is recorded in the privacy
+// audit log.
+//
+// Usage:
+//
+//	appmon-privacy [flags] export|delete|anonymize UID
+//
+// The database connection parameters are read from the PG* environment
+// variables. Exported calls are written to standard output as JSON.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+
+	"github.com/sourcegraph/appmon"
+)
+
+var schema = flag.String("schema", appmon.DBSchema, "appmon database schema")
+var actor = flag.String("actor", defaultActor(), "who requested the operation (recorded in the privacy audit log)")
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: appmon-privacy [flags] export|delete|anonymize UID\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	op, uid := flag.Arg(0), flag.Arg(1)
+
+	appmon.DBSchema = *schema
+	if err := appmon.OpenDB(); err != nil {
+		log.Fatalf("appmon.OpenDB: %s", err)
+	}
+
+	var n int64
+	var err error
+	switch op {
+	case appmon.PrivacyExport:
+		n, err = appmon.ExportUserCalls(os.Stdout, uid, *actor)
+	case appmon.PrivacyDelete:
+		n, err = appmon.DeleteUserCalls(uid, *actor)
+	case appmon.PrivacyAnonymize:
+		n, err = appmon.AnonymizeUserCalls(uid, *actor)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %s", op, err)
+	}
+	log.Printf("%s: %d calls by user %q", op, n, uid)
+}
+
+// defaultActor returns the name of the user running the command.
+func defaultActor() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "appmon-privacy"
+}
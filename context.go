@@ -4,4 +4,7 @@ type contextKey int
 
 const (
 	callID contextKey = iota
+	currentCall
+	notSampled
+	currentMonitor
 )
@@ -7,7 +7,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/sourcegraph/go-nnz/nnz"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,13 +25,15 @@ type DBH interface {
 // dbConn is the global database connection.
 var dbConn *sql.DB
 
-// DB is the global database handle used by all functions in this package that
-// interact with the database.
+// DB is the global database handle used by the package-level functions that
+// interact with the database and by calls tracked without a Monitor. If it is
+// nil, such calls are not stored, but they are still reported to Observers.
+// To use a different database (or schema) for some calls, use a Monitor with
+// its own Store.
 var DB DBH
 
-// DBSchema is the name of the PostgreSQL database schema used for all SQL
-// operations. It is double-quoted in SQL statements sent to the database but
-// not escaped.
+// DBSchema is the name of the PostgreSQL database schema used with DB. It is
+// double-quoted in SQL statements sent to the database but not escaped.
 var DBSchema = "appmon"
 
 // OpenDB connects to the database using connection parameters from the PG*
@@ -40,81 +45,428 @@ func OpenDB() (err error) {
 	return
 }
 
-// InitDBSchema creates the database schema and tables.
-func InitDBSchema() (err error) {
-	_, err = DB.Exec(`
-CREATE SCHEMA "` + DBSchema + `";
-CREATE TABLE "` + DBSchema + `".call (
-  id bigserial NOT NULL,
-  parent_call_id bigint,
+// inTx calls f with a transaction on s.DB, which is committed if f returns
+// nil and rolled back otherwise. If s.DB is already a transaction, f is called
+// with s.DB itself.
+func (s *Store) inTx(f func(dbh DBH) error) (err error) {
+	db, ok := s.DB.(*sql.DB)
+	if !ok {
+		return f(s.DB)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	return f(tx)
+}
 
-  app varchar(24) NOT NULL,
-  host varchar(32) NOT NULL,
+// InitSchema creates the database schema (if it doesn't exist) and applies
+// all pending migrations to it.
+func (s *Store) InitSchema() (err error) {
+	_, err = s.DB.Exec(`CREATE SCHEMA IF NOT EXISTS "` + s.Schema + `"`)
+	if err != nil {
+		return
+	}
+	return s.Migrate()
+}
 
-  remote_addr varchar(24) NOT NULL,
-  user_agent varchar(500) NOT NULL,
-  uid int NULL,
+// DropSchema drops the database schema and tables.
+func (s *Store) DropSchema() (err error) {
+	_, err = s.DB.Exec(`DROP SCHEMA IF EXISTS "` + s.Schema + `" CASCADE`)
+	return
+}
 
-  url varchar(1000) NOT NULL,
-  http_method varchar(12) NOT NULL,
-  route varchar(64) NULL,
-  route_params varchar(1000) NOT NULL,
-  query_params varchar(1000) NOT NULL,
+// insertCall adds a Call to the database and writes its serial ID to c.ID.
+// Field values that are too long to store are truncated in the database, but
+// not in c.
+func (s *Store) insertCall(c *Call) (err error) {
+	t := truncatedForDB(c)
+	var uid, userName, tenant nnz.String
+	var roles []string
+	if t.User != nil {
+		uid, userName, tenant, roles = nnz.String(t.User.ID), nnz.String(t.User.Name), nnz.String(t.User.Tenant), t.User.Roles
+	}
+	return s.DB.QueryRow(`
+INSERT INTO "`+s.Schema+`".call(parent_call_id, app, host, remote_addr, remote_addr_chain, user_agent, uid, user_name, tenant, user_roles, url, http_method, route, route_params, query_params, tags, "start", "end", body_length, http_status_code, err, log)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22) RETURNING id
+`, t.ParentCallID, t.App, t.Host, nnz.String(t.RemoteAddr), nnz.String(t.RemoteAddrChain), t.UserAgent, uid, userName, tenant, pq.Array(roles), t.URL, t.HTTPMethod, t.Route, t.RouteParams, t.QueryParams, t.Tags, t.Start, t.End, t.BodyLength, t.HTTPStatusCode, t.Err, pq.Array(t.Log)).Scan(&c.ID)
+}
 
-  start timestamp(3) NOT NULL,
+// callColumns are the columns that QueryCalls scans into each Call, in order.
+const callColumns = `id, parent_call_id, app, host, remote_addr, remote_addr_chain, user_agent, uid, user_name, tenant, user_roles, url, http_method, route, route_params, query_params, tags, "start", "end", body_length, http_status_code, err, log`
 
-  -- call status fields (filled in post-request)
-  "end" timestamp(3),
-  body_length int,
-  http_status_code int,
-  err text,
+// QueryCalls returns the calls matching q. If q is nil, the most recent
+// DefaultCallLimit calls are returned.
+func (s *Store) QueryCalls(q *CallQuery) (calls []*Call, err error) {
+	if q == nil {
+		q = &CallQuery{}
+	}
+	query, args, err := s.callQuerySQL(q)
+	if err != nil {
+		return nil, err
+	}
 
-  CONSTRAINT call_pkey PRIMARY KEY (id)
-);
-`)
+	var rows *sql.Rows
+	rows, err = s.DB.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := new(Call)
+		var remoteAddr, remoteAddrChain, uid, userName, tenant nnz.String
+		var roles []string
+		err = rows.Scan(
+			&c.ID, &c.ParentCallID, &c.App, &c.Host, &remoteAddr, &remoteAddrChain, &c.UserAgent,
+			&uid, &userName, &tenant, pq.Array(&roles), &c.URL, &c.HTTPMethod,
+			&c.Route, &c.RouteParams, &c.QueryParams, &c.Tags, &c.Start, &c.End, &c.BodyLength, &c.HTTPStatusCode, &c.Err,
+			pq.Array(&c.Log),
+		)
+		if err != nil {
+			return
+		}
+		c.RemoteAddr, c.RemoteAddrChain = string(remoteAddr), string(remoteAddrChain)
+		if uid != "" {
+			c.User = &User{ID: string(uid), Name: string(userName), Tenant: string(tenant), Roles: roles}
+		}
+		calls = append(calls, c)
+	}
+	err = rows.Err()
 	return
 }
 
-// DropDBSchema drops the database schema and tables.
-func DropDBSchema() (err error) {
-	_, err = DB.Exec(`DROP SCHEMA IF EXISTS "` + DBSchema + `" CASCADE`)
+// QueryRouteStats returns statistics about the finished calls matching q's
+// filters, grouped by app and route, with the most frequently called routes
+// first. q's sorting and pagination fields are ignored.
+func (s *Store) QueryRouteStats(q *CallQuery) (stats []*RouteStats, err error) {
+	query, args, err := s.routeStatsSQL(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
+	rows, err = s.DB.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rs := new(RouteStats)
+		var route sql.NullString
+		var avgUsec int64
+		err = rows.Scan(&rs.App, &route, &rs.Count, &avgUsec)
+		if err != nil {
+			return
+		}
+		rs.Route = route.String
+		rs.AvgDuration = time.Duration(avgUsec) * time.Microsecond
+		stats = append(stats, rs)
+	}
+	err = rows.Err()
 	return
 }
 
-// insertCall adds a Call to the database and writes its serial ID to c.ID.
-func insertCall(c *Call) (err error) {
-	return DB.QueryRow(`
-INSERT INTO "`+DBSchema+`".call(parent_call_id, app, host, remote_addr, user_agent, uid, url, http_method, route, route_params, query_params, "start", "end", body_length, http_status_code, err)
-VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id
-`, c.ParentCallID, c.App, c.Host, c.RemoteAddr, c.UserAgent, c.UID, c.URL, c.HTTPMethod, c.Route, c.RouteParams, c.QueryParams, c.Start, c.End, c.BodyLength, c.HTTPStatusCode, c.Err).Scan(&c.ID)
+// QueryUserStats returns statistics about the finished calls by authenticated
+// users matching q's filters, grouped by user (if groupBy is GroupByUser) or by
+// tenant (if groupBy is GroupByTenant), with the most active users or tenants
+// first. q's sorting and pagination fields are ignored.
+func (s *Store) QueryUserStats(q *CallQuery, groupBy string) (stats []*UserStats, err error) {
+	query, args, err := s.userStatsSQL(q, groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
+	rows, err = s.DB.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		us := new(UserStats)
+		var uid, name, tenant sql.NullString
+		var avgUsec int64
+		err = rows.Scan(&uid, &name, &tenant, &us.Count, &us.Failed, &avgUsec)
+		if err != nil {
+			return
+		}
+		us.UID, us.Name, us.Tenant = uid.String, name.String, tenant.String
+		us.AvgDuration = time.Duration(avgUsec) * time.Microsecond
+		stats = append(stats, us)
+	}
+	err = rows.Err()
+	return
 }
 
-// QueryCalls returns all calls matching the SQL query conditions.
-func QueryCalls(query string, args ...interface{}) (calls []*Call, err error) {
+// QueryTagStats returns statistics about the finished calls with the tag key
+// matching q's filters, grouped by the tag's value, with the most frequent
+// values first. q's sorting and pagination fields are ignored.
+func (s *Store) QueryTagStats(q *CallQuery, key string) (stats []*TagStats, err error) {
+	query, args, err := s.tagStatsSQL(q, key)
+	if err != nil {
+		return nil, err
+	}
+
 	var rows *sql.Rows
-	rows, err = DB.Query(`SELECT call.* FROM "`+DBSchema+`".call `+query, args...)
+	rows, err = s.DB.Query(query, args...)
 	if err != nil {
 		return
 	}
+	defer rows.Close()
 	for rows.Next() {
-		c := new(Call)
-		err = rows.Scan(
-			&c.ID, &c.ParentCallID, &c.App, &c.Host, &c.RemoteAddr, &c.UserAgent, &c.UID, &c.URL, &c.HTTPMethod,
-			&c.Route, &c.RouteParams, &c.QueryParams, &c.Start, &c.End, &c.BodyLength, &c.HTTPStatusCode, &c.Err,
-		)
+		ts := new(TagStats)
+		var avgUsec int64
+		err = rows.Scan(&ts.Value, &ts.Count, &ts.Failed, &avgUsec)
 		if err != nil {
 			return
 		}
-		calls = append(calls, c)
+		ts.AvgDuration = time.Duration(avgUsec) * time.Microsecond
+		stats = append(stats, ts)
 	}
+	err = rows.Err()
 	return
 }
 
-func setCallStatus(callID int64, s *CallStatus) (err error) {
-	_, err = DB.Exec(`
-UPDATE "`+DBSchema+`".call SET "end" = $1, body_length = $2, http_status_code = $3, err = $4
-WHERE id = $5
-`, s.End, s.BodyLength, s.HTTPStatusCode, s.Err, callID)
+// callQuerySQL returns the SQL query and arguments that QueryCalls runs for q.
+func (s *Store) callQuerySQL(q *CallQuery) (string, []interface{}, error) {
+	where, err := callQueryConds(s.Schema, q)
+	if err != nil {
+		return "", nil, err
+	}
+	sortExpr, order := callSortExprs[q.sort()], "DESC"
+	if q.Ascending {
+		order = "ASC"
+	}
+	cond, args := where.sql()
+	return `SELECT ` + callColumns + ` FROM "` + s.Schema + `".call ` + cond +
+		` ORDER BY ` + sortExpr + ` ` + order + `, id ` + order + ` LIMIT ` + strconv.Itoa(q.limit()), args, nil
+}
+
+// routeStatsSQL returns the SQL query and arguments that QueryRouteStats runs
+// for q.
+func (s *Store) routeStatsSQL(q *CallQuery) (string, []interface{}, error) {
+	filters := *q
+	filters.Sort, filters.Cursor = "", ""
+	where, err := callQueryConds(s.Schema, &filters)
+	if err != nil {
+		return "", nil, err
+	}
+	where.add(`"end" IS NOT NULL`)
+	cond, args := where.sql()
+	return `
+SELECT app, route, COUNT(*) AS count, ROUND(AVG(extract(epoch from ("end" - "start"))*1000000))::bigint AS avg_duration
+FROM "` + s.Schema + `".call ` + cond + `
+GROUP BY app, route
+ORDER BY count DESC, app, route
+`, args, nil
+}
+
+// userStatsSQL returns the SQL query and arguments that QueryUserStats runs
+// for q and groupBy.
+func (s *Store) userStatsSQL(q *CallQuery, groupBy string) (string, []interface{}, error) {
+	var cols, group string
+	switch groupBy {
+	case GroupByUser:
+		cols, group = `uid, MAX(user_name), MAX(tenant)`, `uid`
+	case GroupByTenant:
+		cols, group = `NULL, NULL, tenant`, `tenant`
+	default:
+		return "", nil, fmt.Errorf("invalid user stats grouping %q", groupBy)
+	}
+
+	filters := *q
+	filters.Sort, filters.Cursor = "", ""
+	where, err := callQueryConds(s.Schema, &filters)
+	if err != nil {
+		return "", nil, err
+	}
+	where.add(`"end" IS NOT NULL`)
+	where.add(group + ` IS NOT NULL`)
+	cond, args := where.sql()
+	return `
+SELECT ` + cols + `, COUNT(*) AS count,
+  COUNT(*) FILTER (WHERE http_status_code < 200 OR http_status_code >= 400),
+  ROUND(AVG(extract(epoch from ("end" - "start"))*1000000))::bigint
+FROM "` + s.Schema + `".call ` + cond + `
+GROUP BY ` + group + `
+ORDER BY count DESC, ` + group + `
+`, args, nil
+}
+
+// tagStatsSQL returns the SQL query and arguments that QueryTagStats runs for
+// q and key.
+func (s *Store) tagStatsSQL(q *CallQuery, key string) (string, []interface{}, error) {
+	if key == "" {
+		return "", nil, errors.New("no tag key given")
+	}
+	value := `(tags ->> ` + pq.QuoteLiteral(key) + `)`
+
+	filters := *q
+	filters.Sort, filters.Cursor = "", ""
+	where, err := callQueryConds(s.Schema, &filters)
+	if err != nil {
+		return "", nil, err
+	}
+	where.add(`"end" IS NOT NULL`)
+	where.add(value + ` IS NOT NULL`)
+	cond, args := where.sql()
+	return `
+SELECT ` + value + ` AS value, COUNT(*) AS count,
+  COUNT(*) FILTER (WHERE http_status_code < 200 OR http_status_code >= 400),
+  ROUND(AVG(extract(epoch from ("end" - "start"))*1000000))::bigint
+FROM "` + s.Schema + `".call ` + cond + `
+GROUP BY value
+ORDER BY count DESC, value
+`, args, nil
+}
+
+// callSortExprs maps CallQuery.Sort values to the SQL expressions that calls
+// are sorted by.
+var callSortExprs = map[string]string{
+	SortByStart:    `"start"`,
+	SortByDuration: `(extract(epoch from ("end" - "start"))*1000000)::bigint`,
+	SortByID:       `id`,
+}
+
+// callQueryConds returns the SQL conditions for q's filters and cursor, for a
+// query of the call table in schema.
+func callQueryConds(schema string, q *CallQuery) (*sqlConds, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	w := &sqlConds{}
+	if q.App != "" {
+		w.add("app = ?", q.App)
+	}
+	if q.Route != "" {
+		w.add("route = ?", q.Route)
+	}
+	if q.Host != "" {
+		w.add("host = ?", q.Host)
+	}
+	if q.UID != "" {
+		w.add("uid = ?", q.UID)
+	}
+	if q.Tenant != "" {
+		w.add("tenant = ?", q.Tenant)
+	}
+	if q.ParentCallID != 0 {
+		w.add("parent_call_id = ?", q.ParentCallID)
+	}
+	if q.TraceCallID != 0 {
+		// UNION (unlike UNION ALL) stops at cycles of parent call IDs.
+		w.add(`id IN (
+  WITH RECURSIVE trace(id) AS (
+    SELECT ?::bigint
+    UNION
+    SELECT c.id FROM "`+schema+`".call c JOIN trace ON c.parent_call_id = trace.id
+  )
+  SELECT id FROM trace
+)`, q.TraceCallID)
+	}
+	if q.StatusMin != 0 {
+		w.add("http_status_code >= ?", q.StatusMin)
+	}
+	if q.StatusMax != 0 {
+		w.add("http_status_code <= ?", q.StatusMax)
+	}
+	if q.Failed {
+		w.add("(http_status_code < 200 OR http_status_code >= 400)")
+	}
+	if !q.Since.IsZero() {
+		w.add(`"start" >= ?`, q.Since.In(time.UTC))
+	}
+	if !q.Until.IsZero() {
+		w.add(`"start" < ?`, q.Until.In(time.UTC))
+	}
+	if q.MinDuration != 0 {
+		w.add(callSortExprs[SortByDuration]+" >= ?", int64(q.MinDuration/time.Microsecond))
+	}
+	if q.URLContains != "" {
+		w.add("url LIKE ?", "%"+likeEscaper.Replace(q.URLContains)+"%")
+	}
+	if len(q.RouteParams) > 0 {
+		data, err := json.Marshal(q.RouteParams)
+		if err != nil {
+			return nil, err
+		}
+		w.add("route_params @> ?::jsonb", string(data))
+	}
+	if len(q.Tags) > 0 {
+		data, err := json.Marshal(q.Tags)
+		if err != nil {
+			return nil, err
+		}
+		w.add("tags @> ?::jsonb", string(data))
+	}
+	if len(q.QueryParams) > 0 {
+		// Querystring parameter values are stored as lists.
+		vals := make(map[string][]string, len(q.QueryParams))
+		for k, v := range q.QueryParams {
+			vals[k] = []string{v}
+		}
+		data, err := json.Marshal(vals)
+		if err != nil {
+			return nil, err
+		}
+		w.add("query_params @> ?::jsonb", string(data))
+	}
+	if q.sort() == SortByDuration {
+		w.add(`"end" IS NOT NULL`)
+	}
+	if q.Cursor != "" {
+		cur, err := q.decodeCursor()
+		if err != nil {
+			return nil, err
+		}
+		cmp := "<"
+		if q.Ascending {
+			cmp = ">"
+		}
+		w.add("("+callSortExprs[q.sort()]+", id) "+cmp+" (?, ?)", cur.Val, cur.ID)
+	}
+	return w, nil
+}
+
+// sqlConds builds a SQL WHERE clause from conditions that use "?" as the
+// placeholder for their arguments.
+type sqlConds struct {
+	conds []string
+	args  []interface{}
+}
+
+func (c *sqlConds) add(cond string, args ...interface{}) {
+	for _, arg := range args {
+		c.args = append(c.args, arg)
+		cond = strings.Replace(cond, "?", "$"+strconv.Itoa(len(c.args)), 1)
+	}
+	c.conds = append(c.conds, cond)
+}
+
+func (c *sqlConds) sql() (string, []interface{}) {
+	if len(c.conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(c.conds, " AND "), c.args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// setCallStatus records the status of a finished call. If tags is non-nil, it
+// replaces the call's stored tags (which may have been set after the call was
+// inserted). If logLines is non-nil, it replaces the call's stored log lines.
+func (s *Store) setCallStatus(callID int64, status *CallStatus, tags Params, logLines []string) (err error) {
+	_, err = s.DB.Exec(`
+UPDATE "`+s.Schema+`".call SET "end" = $1, body_length = $2, http_status_code = $3, err = $4, tags = COALESCE($5::jsonb, tags), log = COALESCE($6::text[], log)
+WHERE id = $7
+`, status.End, status.BodyLength, status.HTTPStatusCode, status.Err, truncateParams("tags", tags), pq.Array(truncateLines("log", logLines)), callID)
 	return
 }
 
@@ -123,13 +475,23 @@ func (x Params) Value() (driver.Value, error) {
 	if x == nil {
 		return nil, nil
 	}
-	return json.Marshal(x)
+	data, err := json.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
 }
 
 // Scan implements the database/sql/driver.Scanner interface.
 func (x *Params) Scan(v interface{}) error {
-	if data, ok := v.([]byte); ok {
-		return json.Unmarshal(data, x)
+	switch v := v.(type) {
+	case nil:
+		*x = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, x)
+	case string:
+		return json.Unmarshal([]byte(v), x)
 	}
 	return fmt.Errorf("%T.Scan failed: %v", x, v)
 }
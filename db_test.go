@@ -14,12 +14,17 @@ var initSchema = flag.Bool("test.initschema", false, "initialize the test appmon
 
 var dropSchemaOnce sync.Once
 var initSchemaOnce sync.Once
+var migrateOnce sync.Once
+var migrateErr error
 
-func dbSetUp() {
+// dbSetUp sets DB to a transaction on the test database, which dbTearDown
+// rolls back. The test is skipped if the test schema doesn't exist (and
+// -test.initschema wasn't given).
+func dbSetUp(t *testing.T) {
 	DBSchema = "test_appmon"
 	err := OpenDB()
 	if err != nil {
-		panic("OpenDB: " + err.Error())
+		t.Fatal("OpenDB:", err)
 	}
 
 	if *dropSchema {
@@ -39,9 +44,22 @@ func dbSetUp() {
 		})
 	}
 
+	var exists bool
+	err = dbConn.QueryRow(`SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = $1)`, DBSchema).Scan(&exists)
+	if err != nil {
+		t.Fatal("checking for test schema:", err)
+	}
+	if !exists {
+		t.Skipf("test schema %q doesn't exist (run tests with -test.initschema to create it)", DBSchema)
+	}
+	migrateOnce.Do(func() { migrateErr = MigrateDB() })
+	if migrateErr != nil {
+		t.Fatal("MigrateDB:", migrateErr)
+	}
+
 	DB, err = dbConn.Begin()
 	if err != nil {
-		panic("dbConn.Begin: " + err.Error())
+		t.Fatal("dbConn.Begin:", err)
 	}
 }
 
@@ -63,12 +81,13 @@ func makeCall() *Call {
 		ParentCallID: 123,
 		App:          "api",
 		Host:         "example.com",
-		UID:          123,
+		User:         &User{ID: "123", Name: "Alice", Tenant: "acme", Roles: []string{"admin"}},
 		URL:          "http://example.com/foo",
 		HTTPMethod:   "GET",
 		Route:        "my-route",
 		RouteParams:  map[string]interface{}{"k1": "v1"},
 		QueryParams:  map[string]interface{}{"k2": "v2"},
+		Tags:         map[string]interface{}{"plan": "pro"},
 		Start:        dbNow(),
 		CallStatus: CallStatus{
 			End:            now(),
@@ -80,11 +99,11 @@ func makeCall() *Call {
 }
 
 func TestInsertCall(t *testing.T) {
-	dbSetUp()
+	dbSetUp(t)
 	defer dbTearDown()
 
 	c := makeCall()
-	err := insertCall(c)
+	err := defaultStore().insertCall(c)
 	if err != nil {
 		t.Fatal("insertCall", err)
 	}
@@ -101,17 +120,17 @@ func TestInsertCall(t *testing.T) {
 }
 
 func TestSetCallStatus(t *testing.T) {
-	dbSetUp()
+	dbSetUp(t)
 	defer dbTearDown()
 
 	c := makeCall()
-	err := insertCall(c)
+	err := defaultStore().insertCall(c)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	s := &CallStatus{End: now(), BodyLength: 456, HTTPStatusCode: 200, Err: "my error"}
-	err = setCallStatus(c.ID, s)
+	err = defaultStore().setCallStatus(c.ID, s, nil, nil)
 	if err != nil {
 		t.Fatal("insertCallStatus", err)
 	}
@@ -128,7 +147,7 @@ func TestSetCallStatus(t *testing.T) {
 // getOnlyOneCall returns the only Call in the database if there is exactly 1
 // Call in the database, and calls t.Fatalf otherwise.
 func getOnlyOneCall(t *testing.T) *Call {
-	cs, err := QueryCalls("")
+	cs, err := QueryCalls(nil)
 	if err != nil {
 		t.Fatal("QueryCalls", err)
 	}
@@ -153,3 +172,122 @@ func normalizeCall(c *Call) {
 	c.RemoteAddr = ""
 	c.UserAgent = ""
 }
+
+func TestQueryCalls_CallQuery(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	start := dbNow()
+	var ids []int64
+	for i, route := range []string{"a", "b", "a"} {
+		c := makeCall()
+		c.Route = route
+		c.URL = "http://example.com/" + route + "%_"
+		c.Start = start.Add(time.Duration(i) * time.Second)
+		c.HTTPStatusCode = 200 + 300*(i%2)
+		c.RouteParams = Params{"id": []string{"0", "1", "2"}[i]}
+		c.QueryParams = Params{"q": []string{route, "x"}}
+		c.Tags = Params{"variant": []string{"x", "y", "x"}[i]}
+		if err := defaultStore().insertCall(c); err != nil {
+			t.Fatal("insertCall", err)
+		}
+		ids = append(ids, c.ID)
+	}
+
+	tests := []struct {
+		q       *CallQuery
+		wantIDs []int64
+	}{
+		{&CallQuery{}, []int64{ids[2], ids[1], ids[0]}},
+		{&CallQuery{Ascending: true}, []int64{ids[0], ids[1], ids[2]}},
+		{&CallQuery{Route: "a"}, []int64{ids[2], ids[0]}},
+		{&CallQuery{Failed: true}, []int64{ids[1]}},
+		{&CallQuery{StatusMax: 299}, []int64{ids[2], ids[0]}},
+		{&CallQuery{URLContains: "b%_"}, []int64{ids[1]}},
+		{&CallQuery{URLContains: "b%%"}, nil},
+		{&CallQuery{Since: start.Add(time.Second)}, []int64{ids[2], ids[1]}},
+		{&CallQuery{Limit: 1}, []int64{ids[2]}},
+		{&CallQuery{RouteParams: map[string]string{"id": "1"}}, []int64{ids[1]}},
+		{&CallQuery{QueryParams: map[string]string{"q": "a"}}, []int64{ids[2], ids[0]}},
+		{&CallQuery{QueryParams: map[string]string{"q": "x"}, RouteParams: map[string]string{"id": "2"}}, []int64{ids[2]}},
+		{&CallQuery{QueryParams: map[string]string{"q": "y"}}, nil},
+		{&CallQuery{Tags: map[string]string{"variant": "y"}}, []int64{ids[1]}},
+		{&CallQuery{Tags: map[string]string{"variant": "x"}, Route: "a"}, []int64{ids[2], ids[0]}},
+	}
+	for _, test := range tests {
+		calls, err := QueryCalls(test.q)
+		if err != nil {
+			t.Errorf("%+v: QueryCalls: %s", test.q, err)
+			continue
+		}
+		var gotIDs []int64
+		for _, c := range calls {
+			gotIDs = append(gotIDs, c.ID)
+		}
+		if !reflect.DeepEqual(test.wantIDs, gotIDs) {
+			t.Errorf("%+v: want IDs %v, got %v", test.q, test.wantIDs, gotIDs)
+		}
+	}
+
+	// Paginate through all calls, one at a time.
+	q := &CallQuery{Limit: 1}
+	var gotIDs []int64
+	for {
+		calls, err := QueryCalls(q)
+		if err != nil {
+			t.Fatal("QueryCalls", err)
+		}
+		if len(calls) == 0 {
+			break
+		}
+		gotIDs = append(gotIDs, calls[0].ID)
+		q.Cursor = q.CallCursor(calls[0])
+	}
+	if want := []int64{ids[2], ids[1], ids[0]}; !reflect.DeepEqual(want, gotIDs) {
+		t.Errorf("paginated: want IDs %v, got %v", want, gotIDs)
+	}
+}
+
+func TestQueryUserStats(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	users := []*User{
+		{ID: "alice", Name: "Alice", Tenant: "acme"},
+		{ID: "alice", Name: "Alice", Tenant: "acme"},
+		{ID: "bob", Tenant: "acme"},
+		{ID: "carol", Tenant: "initech"},
+		nil,
+	}
+	for i, u := range users {
+		c := makeCall()
+		c.User = u
+		c.HTTPStatusCode = 200 + 300*(i%2)
+		if err := defaultStore().insertCall(c); err != nil {
+			t.Fatal("insertCall", err)
+		}
+	}
+
+	byUser, err := QueryUserStats(&CallQuery{}, GroupByUser)
+	if err != nil {
+		t.Fatal("QueryUserStats", err)
+	}
+	if len(byUser) != 3 {
+		t.Fatalf("want 3 users, got %d", len(byUser))
+	}
+	if u := byUser[0]; u.UID != "alice" || u.Name != "Alice" || u.Tenant != "acme" || u.Count != 2 || u.Failed != 1 {
+		t.Errorf("got top user %+v", u)
+	}
+
+	byTenant, err := QueryUserStats(&CallQuery{Tenant: "acme"}, GroupByTenant)
+	if err != nil {
+		t.Fatal("QueryUserStats", err)
+	}
+	if len(byTenant) != 1 || byTenant[0].Tenant != "acme" || byTenant[0].Count != 3 || byTenant[0].UID != "" {
+		t.Errorf("got tenant stats %+v", byTenant)
+	}
+
+	if _, err := QueryUserStats(&CallQuery{}, "foo"); err == nil {
+		t.Error("want error for invalid grouping")
+	}
+}
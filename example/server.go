@@ -5,13 +5,16 @@ import (
 	"flag"
 	"github.com/gorilla/mux"
 	"github.com/sourcegraph/appmon"
+	"github.com/sourcegraph/appmon/otlp"
 	"github.com/sourcegraph/appmon/panel"
+	"github.com/sourcegraph/appmon/zipkin"
 	"go/build"
 	"html/template"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -22,9 +25,18 @@ var bind = flag.String("http", ":8888", "HTTP bind address")
 var baseURLStr = flag.String("url", "http://localhost:8888", "base URL of this server")
 var dir = flag.String("dir", filepath.Join(defaultBase("github.com/sourcegraph/appmon"), "example"), "path to github.com/sourcegraph/appmon/example dir")
 var dropSchema = flag.Bool("dropdb", false, "drop the appmon schema before initializing it")
-var initSchema = flag.Bool("initdb", false, "initialize the appmon schema before running")
+var initSchema = flag.Bool("initdb", false, "initialize the appmon schema and apply pending migrations before running")
 
-var authUID = flag.Int("uid", 0, "consider all HTTP requests as authenticated as this UID (if non-zero)")
+var statsdAddr = flag.String("statsd", "", "send call metrics to this StatsD server (host:port)")
+var otlpEndpoint = flag.String("otlp", "", "export calls as spans to this OTLP/HTTP traces endpoint (e.g., http://localhost:4318/v1/traces)")
+var zipkinEndpoint = flag.String("zipkin", "", "export calls as spans to this Zipkin endpoint (e.g., http://localhost:9411/api/v2/spans)")
+var accessLog = flag.Bool("accesslog", false, "write a JSON line for each call to stdout")
+var scrubKey = flag.String("scrub-key", "", "scrub PII from calls, replacing it with hashes keyed by this secret (if nonempty)")
+var anonymizeIP = flag.String("anonymize-ip", "", "anonymize client IP addresses by truncating them (\"truncate\") or replacing them with hashes keyed by -scrub-key (\"hash\")")
+var trustedProxies = flag.String("trusted-proxies", "", "comma-separated CIDR networks of trusted reverse proxies (e.g., 10.0.0.0/8)")
+
+var authUID = flag.String("uid", "", "consider all HTTP requests as authenticated as this user ID (if nonempty)")
+var authTenant = flag.String("tenant", "", "tenant of the user given by -uid")
 
 var rt *mux.Router
 var baseURL *url.URL
@@ -61,7 +73,59 @@ func main() {
 		}
 	}
 
+	if *trustedProxies != "" {
+		err = appmon.TrustProxies(strings.Split(*trustedProxies, ",")...)
+		if err != nil {
+			log.Fatalf("TrustProxies: %s", err)
+		}
+	}
+
+	if *scrubKey != "" {
+		appmon.Scrubbers = append(appmon.Scrubbers, appmon.NewPIIScrubber([]byte(*scrubKey)))
+	}
+	switch *anonymizeIP {
+	case "":
+	case "truncate":
+		appmon.Scrubbers = append(appmon.Scrubbers, &appmon.IPAnonymizer{})
+	case "hash":
+		if *scrubKey == "" {
+			log.Fatal("-anonymize-ip=hash requires -scrub-key")
+		}
+		appmon.Scrubbers = append(appmon.Scrubbers, &appmon.IPAnonymizer{Key: []byte(*scrubKey)})
+	default:
+		log.Fatalf("bad -anonymize-ip value %q", *anonymizeIP)
+	}
+
+	metrics := &appmon.Metrics{}
+	appmon.Observers = append(appmon.Observers, metrics)
+	if *accessLog {
+		l, err := appmon.NewAccessLog(os.Stdout)
+		if err != nil {
+			log.Fatalf("NewAccessLog: %s", err)
+		}
+		appmon.Observers = append(appmon.Observers, l)
+	}
+	if *statsdAddr != "" {
+		statsd, err := appmon.NewStatsD(*statsdAddr, appmon.StatsDOptions{Prefix: "appmon."})
+		if err != nil {
+			log.Fatalf("NewStatsD: %s", err)
+		}
+		defer statsd.Close()
+		appmon.Observers = append(appmon.Observers, statsd)
+	}
+	if *otlpEndpoint != "" {
+		exporter := otlp.NewExporter(otlp.Options{Endpoint: *otlpEndpoint})
+		defer exporter.Close()
+		appmon.Observers = append(appmon.Observers, exporter)
+	}
+	if *zipkinEndpoint != "" {
+		exporter := zipkin.NewExporter(zipkin.Options{Endpoint: *zipkinEndpoint})
+		defer exporter.Close()
+		appmon.Observers = append(appmon.Observers, exporter)
+	}
+
 	rt = mux.NewRouter()
+	rt.Path("/metrics").Handler(metrics)
 	t := rt.PathPrefix("/api/appmon").Subrouter()
 	panel.Router(t)
 	panel.UIRouter("/admin/", rt.PathPrefix("/admin").Subrouter())
@@ -71,9 +135,9 @@ func main() {
 	rt.Path("/").Handler(appmon.TrackAPICall("example", http.HandlerFunc(home)))
 	http.Handle("/", rt)
 
-	if *authUID != 0 {
-		appmon.CurrentUser = func(r *http.Request) int {
-			return *authUID
+	if *authUID != "" {
+		appmon.CurrentUser = func(r *http.Request) *appmon.User {
+			return &appmon.User{ID: *authUID, Tenant: *authTenant}
 		}
 	}
 
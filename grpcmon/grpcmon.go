@@ -0,0 +1,260 @@
+// Package grpcmon tracks gRPC calls with appmon.
+//
+// Server interceptors (see Server) track each incoming RPC as an appmon call,
+// with the full method name (e.g., "/pkg.Service/Method") as its Route. Client
+// interceptors propagate the current call ID to the server in the RPC's
+// metadata, so that the server's calls are recorded as its children.
+package grpcmon
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/sourcegraph/appmon"
+	"github.com/sourcegraph/go-nnz/nnz"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Method is the HTTPMethod of calls that track RPCs.
+const Method = "GRPC"
+
+// ParentCallIDKey is the gRPC metadata key that contains the parent call ID
+// of an RPC. It is appmon.ParentCallIDHeader in lowercase, since gRPC metadata
+// keys are lowercase.
+const ParentCallIDKey = "x-appmon-parent-call-id"
+
+type contextKey int
+
+const (
+	callIDKey contextKey = iota
+	callKey
+)
+
+// NewContext returns a copy of ctx that carries callID, which client
+// interceptors send as the parent call ID of outgoing RPCs. Server
+// interceptors add the ID of the RPC's call to its context; to make RPCs on
+// behalf of other calls (e.g., HTTP requests tracked by appmon), use the ID
+// from appmon.GetCallID.
+func NewContext(ctx context.Context, callID int64) context.Context {
+	return context.WithValue(ctx, callIDKey, callID)
+}
+
+// FromContext returns the call ID carried by ctx, if any.
+func FromContext(ctx context.Context) (callID int64, ok bool) {
+	callID, ok = ctx.Value(callIDKey).(int64)
+	return
+}
+
+// SetTag sets the tag key to value on the call of the RPC being handled with
+// ctx (see appmon.SetTag). It has no effect if ctx isn't the context of an RPC
+// tracked by a Server.
+func SetTag(ctx context.Context, key, value string) {
+	if c, ok := ctx.Value(callKey).(*appmon.Call); ok {
+		c.SetTag(key, value)
+	}
+}
+
+// Logger returns a logger for the call of the RPC being handled with ctx (see
+// appmon.Logger). If ctx isn't the context of an RPC tracked by a Server, base
+// is returned.
+func Logger(ctx context.Context, base *log.Logger) *log.Logger {
+	if c, ok := ctx.Value(callKey).(*appmon.Call); ok {
+		return c.Logger(base)
+	}
+	return base
+}
+
+// LogHandler returns a slog.Handler for the call of the RPC being handled with
+// ctx (see appmon.LogHandler). If ctx isn't the context of an RPC tracked by a
+// Server, h is returned.
+func LogHandler(ctx context.Context, h slog.Handler) slog.Handler {
+	if c, ok := ctx.Value(callKey).(*appmon.Call); ok {
+		return c.LogHandler(h)
+	}
+	return h
+}
+
+// A Server provides gRPC server interceptors that track incoming RPCs with a
+// Monitor. Monitor.Sampler and Monitor.CurrentUser (which need an HTTP
+// request) are not used.
+type Server struct {
+	// Monitor tracks the RPCs. If nil, the default Monitor for App
+	// (configured by appmon's package-level variables; see
+	// appmon.DefaultMonitor) is used.
+	Monitor *appmon.Monitor
+
+	// App is the app that RPCs are recorded as calls to if Monitor is nil.
+	// If Monitor is set, Monitor.App is used instead.
+	App string
+
+	// CurrentUser, if set, is called to determine the currently
+	// authenticated user for an RPC (e.g., from credentials in its
+	// metadata). The returned user is stored in the call if it's non-nil
+	// and has a nonempty ID.
+	CurrentUser func(ctx context.Context) *appmon.User
+}
+
+// monitor returns the Monitor that tracks an RPC.
+func (s *Server) monitor() *appmon.Monitor {
+	if s.Monitor != nil {
+		return s.Monitor
+	}
+	return appmon.DefaultMonitor(s.App)
+}
+
+// UnaryInterceptor returns a gRPC unary server interceptor that tracks RPCs.
+func (s *Server) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		m := s.monitor()
+		c := s.startCall(ctx, m, info.FullMethod)
+		resp, err := handler(newCallContext(ctx, c), req)
+		finishCall(m, c, err)
+		return resp, err
+	}
+}
+
+// StreamInterceptor returns a gRPC stream server interceptor that tracks
+// RPCs. A streaming RPC's call lasts until the handler returns.
+func (s *Server) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		m := s.monitor()
+		c := s.startCall(ss.Context(), m, info.FullMethod)
+		err := handler(srv, &serverStream{ss, newCallContext(ss.Context(), c)})
+		finishCall(m, c, err)
+		return err
+	}
+}
+
+// newCallContext returns a copy of ctx that carries the RPC's call c.
+func newCallContext(ctx context.Context, c *appmon.Call) context.Context {
+	return context.WithValue(NewContext(ctx, c.ID), callKey, c)
+}
+
+// serverStream is a grpc.ServerStream with a different context.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context { return ss.ctx }
+
+func (s *Server) startCall(ctx context.Context, m *appmon.Monitor, method string) *appmon.Call {
+	c := &appmon.Call{
+		URL:         method,
+		HTTPMethod:  Method,
+		Route:       method,
+		RouteParams: appmon.Params{},
+		QueryParams: appmon.Params{},
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(ParentCallIDKey); len(v) > 0 {
+			if id, err := strconv.ParseInt(v[0], 10, 64); err == nil && id > 0 {
+				c.ParentCallID = nnz.Int64(id)
+			}
+		}
+		if v := md.Get("user-agent"); len(v) > 0 {
+			c.UserAgent = v[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		c.RemoteAddr = peerAddr(p.Addr)
+	}
+	if s.CurrentUser != nil {
+		if u := s.CurrentUser(ctx); u != nil && u.ID != "" {
+			c.User = u
+		}
+	}
+	m.StartCall(c)
+	return c
+}
+
+func finishCall(m *appmon.Monitor, c *appmon.Call, err error) {
+	st := status.Convert(err)
+	cs := appmon.CallStatus{HTTPStatusCode: HTTPStatusCode(st.Code())}
+	if err != nil {
+		cs.Err = nnz.String(st.Code().String() + ": " + st.Message())
+	}
+	m.FinishCall(c, cs)
+}
+
+// peerAddr returns the IP address of a peer, without its port.
+func peerAddr(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// HTTPStatusCode returns the HTTP status code that corresponds to a gRPC
+// status code, which is recorded as the HTTPStatusCode of an RPC's call so
+// that failed RPCs are treated like failed HTTP requests. The mapping is the
+// one used by gRPC-HTTP gateways.
+func HTTPStatusCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// UnaryClientInterceptor returns a gRPC unary client interceptor that sends
+// the call ID carried by the RPC's context (see NewContext), if any, as the
+// RPC's parent call ID.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns a gRPC stream client interceptor that sends
+// the call ID carried by the RPC's context (see NewContext), if any, as the
+// RPC's parent call ID.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+	}
+}
+
+// outgoingContext adds the call ID carried by ctx to its outgoing metadata.
+func outgoingContext(ctx context.Context) context.Context {
+	callID, ok := FromContext(ctx)
+	if !ok || callID == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, ParentCallIDKey, strconv.FormatInt(callID, 10))
+}
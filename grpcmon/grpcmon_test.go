@@ -0,0 +1,155 @@
+package grpcmon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/sourcegraph/appmon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type callRecorder struct{ calls chan *appmon.Call }
+
+func (r *callRecorder) CallStarted(c *appmon.Call)  {}
+func (r *callRecorder) CallFinished(c *appmon.Call) { r.calls <- c }
+
+// taggingHealthServer tags and logs the calls of Check RPCs.
+type taggingHealthServer struct{ *health.Server }
+
+func (s *taggingHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	SetTag(ctx, "service", req.Service)
+	Logger(ctx, log.New(io.Discard, "", 0)).Printf("checking %s", req.Service)
+	return s.Server.Check(ctx, req)
+}
+
+// newTestServer starts a gRPC health server whose RPCs are tracked, and
+// returns a client connection to it.
+func newTestServer(t *testing.T) (*grpc.ClientConn, *callRecorder) {
+	obs := &callRecorder{calls: make(chan *appmon.Call, 10)}
+	s := &Server{
+		Monitor:     &appmon.Monitor{App: "rpc", Observers: []appmon.Observer{obs}, Live: &appmon.Hub{}, LogCapture: &appmon.LogCapture{}},
+		CurrentUser: func(ctx context.Context) *appmon.User { return &appmon.User{ID: "alice"} },
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(s.UnaryInterceptor()), grpc.StreamInterceptor(s.StreamInterceptor()))
+	hs := health.NewServer()
+	hs.SetServingStatus("ok", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, &taggingHealthServer{hs})
+
+	l := bufconn.Listen(1 << 20)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(StreamClientInterceptor()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, obs
+}
+
+func TestUnary(t *testing.T) {
+	conn, obs := newTestServer(t)
+	client := healthpb.NewHealthClient(conn)
+
+	ctx := NewContext(context.Background(), 123)
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	c := <-obs.calls
+	if want := "/grpc.health.v1.Health/Check"; c.Route != want {
+		t.Errorf("got Route %q, want %q", c.Route, want)
+	}
+	if c.App != "rpc" || c.HTTPMethod != Method || c.ParentCallID != 123 || c.HTTPStatusCode != http.StatusOK || c.Err != "" {
+		t.Errorf("bad call: %+v", c)
+	}
+	if c.User == nil || c.User.ID != "alice" {
+		t.Errorf("got User %+v, want alice", c.User)
+	}
+	if c.Tags["service"] != "ok" {
+		t.Errorf("got Tags %v, want service=ok", c.Tags)
+	}
+	if c.Log != nil {
+		t.Errorf("got Log %q for successful call, want none", c.Log)
+	}
+
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "unknown"}); err == nil {
+		t.Fatal("want error for unknown service")
+	}
+	c = <-obs.calls
+	if c.ParentCallID != 0 || c.HTTPStatusCode != http.StatusNotFound || c.Err == "" {
+		t.Errorf("bad call: %+v", c)
+	}
+	if want := fmt.Sprintf("call_id=%d checking unknown", c.ID); len(c.Log) != 1 || c.Log[0] != want {
+		t.Errorf("got Log %q, want [%q]", c.Log, want)
+	}
+}
+
+func TestStream(t *testing.T) {
+	conn, obs := newTestServer(t)
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithCancel(NewContext(context.Background(), 123))
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	c := <-obs.calls
+	if want := "/grpc.health.v1.Health/Watch"; c.Route != want {
+		t.Errorf("got Route %q, want %q", c.Route, want)
+	}
+	if c.ParentCallID != 123 || c.HTTPStatusCode != HTTPStatusCode(codes.Canceled) {
+		t.Errorf("bad call: %+v", c)
+	}
+}
+
+func TestServer_DefaultMonitor(t *testing.T) {
+	obs := &callRecorder{calls: make(chan *appmon.Call, 1)}
+	orig := appmon.Observers
+	defer func() { appmon.Observers = orig }()
+	appmon.Observers = []appmon.Observer{obs}
+
+	s := &Server{App: "rpc"}
+	h := s.UnaryInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	if _, err := h(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-obs.calls; c.Route != info.FullMethod || c.App != "rpc" {
+		t.Errorf("got Route %q and App %q, want %q and %q", c.Route, c.App, info.FullMethod, "rpc")
+	}
+}
+
+func TestHTTPStatusCode(t *testing.T) {
+	for code, want := range map[codes.Code]int{
+		codes.OK:               http.StatusOK,
+		codes.NotFound:         http.StatusNotFound,
+		codes.Unauthenticated:  http.StatusUnauthorized,
+		codes.DeadlineExceeded: http.StatusGatewayTimeout,
+		codes.Internal:         http.StatusInternalServerError,
+		codes.Unknown:          http.StatusInternalServerError,
+	} {
+		if got := HTTPStatusCode(code); got != want {
+			t.Errorf("%s: got %d, want %d", code, got, want)
+		}
+	}
+}
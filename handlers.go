@@ -1,80 +1,134 @@
 package appmon
 
 import (
-	"github.com/gorilla/mux"
+	"github.com/gorilla/context"
 	"github.com/sourcegraph/go-nnz/nnz"
 	"log"
 	"net/http"
-	"time"
 )
 
 // CurrentUser, if set, is called to determine the currently authenticated user
-// for the current request. The returned user ID is stored in the Call record if
-// nonzero.
-var CurrentUser func(r *http.Request) int
+// for the current request (for calls tracked without a Monitor). The returned
+// user is stored in the Call record if it's non-nil and has a nonempty ID.
+var CurrentUser func(r *http.Request) *User
 
+// BeforeAPICall starts tracking a call to app for r, using the default Monitor
+// configured by the package-level variables.
 func BeforeAPICall(app string, r *http.Request) {
+	DefaultMonitor(app).BeforeAPICall(r)
+}
+
+// AfterAPICall finishes tracking the call for r started by BeforeAPICall,
+// using the Monitor that started it.
+func AfterAPICall(r *http.Request, bodyLength, code int, errStr string) {
+	m, ok := getMonitor(r)
+	if !ok {
+		m = DefaultMonitor("")
+	}
+	m.AfterAPICall(r, bodyLength, code, errStr)
+}
+
+// BeforeAPICall starts tracking a call for r, unless r isn't sampled by
+// m.Sampler.
+func (m *Monitor) BeforeAPICall(r *http.Request) {
+	if m.Sampler != nil && !m.Sampler.Sample(r) {
+		setNotSampled(r)
+		return
+	}
+
+	route, routeParams := resolveRoute(m.routeResolvers(), r)
 	c := &Call{
-		App:         app,
-		Host:        hostname,
-		RemoteAddr:  r.RemoteAddr,
 		UserAgent:   r.UserAgent(),
 		URL:         r.URL.String(),
 		HTTPMethod:  r.Method,
-		Route:       mux.CurrentRoute(r).GetName(),
-		RouteParams: mapStringStringAsParams(mux.Vars(r)),
+		Route:       route,
+		RouteParams: mapStringStringAsParams(routeParams),
 		QueryParams: mapStringSliceOfStringAsParams(r.URL.Query()),
-		Start:       time.Now().In(time.UTC),
 	}
+	c.RemoteAddr, c.RemoteAddrChain = clientAddr(r, m.TrustedProxies)
 	if parentCallID, ok := GetParentCallID(r); ok {
 		c.ParentCallID = nnz.Int64(parentCallID)
 	}
-	if CurrentUser != nil {
-		c.UID = nnz.Int(CurrentUser(r))
-	}
-
-	err := insertCall(c)
-	if err != nil {
-		log.Printf("insertCall failed: %s", err)
+	if m.CurrentUser != nil {
+		if u := m.CurrentUser(r); u != nil && u.ID != "" {
+			c.User = u
+		}
 	}
+	m.StartCall(c)
 	setCallID(r, c.ID)
+	setCall(r, c)
+	setMonitor(r, m)
 }
 
-func AfterAPICall(r *http.Request, bodyLength, code int, errStr string) {
+// AfterAPICall finishes tracking the call for r started by BeforeAPICall. r's
+// call ID remains available (see GetCallID) until r's gorilla/context values
+// are cleared, which callers that don't use Handler must do (with
+// context.Clear) when they're done with r.
+func (m *Monitor) AfterAPICall(r *http.Request, bodyLength, code int, errStr string) {
 	callID, ok := GetCallID(r)
 	if !ok {
-		log.Printf("AfterAPICall: no CallID")
+		if !isNotSampled(r) {
+			log.Printf("AfterAPICall: no CallID")
+		}
 		return
 	}
 
-	err := setCallStatus(callID, &CallStatus{
+	s := CallStatus{
 		End:            now(),
 		BodyLength:     bodyLength,
 		HTTPStatusCode: code,
 		Err:            nnz.String(errStr),
-	})
-	if err != nil {
-		log.Printf("setCallStatus failed for call ID %d: %s", callID, err)
+	}
+	if c, ok := getCall(r); ok {
+		m.FinishCall(c, s)
+		clearCall(r)
+	} else if m.Store != nil {
+		err := m.Store.setCallStatus(callID, &s, nil, nil)
+		if err != nil {
+			log.Printf("setCallStatus failed for call ID %d: %s", callID, err)
+		}
 	}
 }
 
+// A Handler tracks calls to the wrapped Handler. If Monitor is nil, the
+// default Monitor (configured by the package-level variables) is used;
+// otherwise App is ignored and Monitor.App is used.
 type Handler struct {
 	App     string
 	Handler http.Handler
+	Monitor *Monitor
+}
+
+func (h Handler) monitor() *Monitor {
+	if h.Monitor != nil {
+		return h.Monitor
+	}
+	return DefaultMonitor(h.App)
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	BeforeAPICall(h.App, r)
+	// gorilla/mux no longer clears gorilla/context values, so clear r's to
+	// avoid leaking them.
+	defer context.Clear(r)
+
+	m := h.monitor()
+	m.BeforeAPICall(r)
 
 	rw := newRecorder(w)
 	h.Handler.ServeHTTP(rw, r)
 
-	AfterAPICall(r, rw.BodyLength, rw.Code, "")
+	m.AfterAPICall(r, rw.BodyLength, rw.Code, "")
 }
 
 // TrackAPICall wraps an API endpoint handler and records incoming API calls.
 func TrackAPICall(app string, h http.Handler) http.Handler {
-	return Handler{app, h}
+	return Handler{App: app, Handler: h}
+}
+
+// TrackAPICall wraps an API endpoint handler and records incoming API calls
+// with m.
+func (m *Monitor) TrackAPICall(h http.Handler) http.Handler {
+	return Handler{Handler: h, Monitor: m}
 }
 
 func mapStringStringAsParams(m map[string]string) (p Params) {
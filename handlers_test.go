@@ -3,16 +3,18 @@ package appmon
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/sourcegraph/go-nnz/nnz"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 	"time"
 )
 
 func TestTrackView(t *testing.T) {
-	dbSetUp()
+	dbSetUp(t)
 	httpSetUp()
 	defer dbTearDown()
 	defer httpTearDown()
@@ -103,7 +105,7 @@ func TestTrackView(t *testing.T) {
 		t.Errorf("!calledViewHandler")
 	}
 
-	calls, err := QueryCalls("")
+	calls, err := QueryCalls(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,7 +129,7 @@ func toJSON(t *testing.T, v interface{}) string {
 }
 
 func TestTrackAPICall_NoParentCall(t *testing.T) {
-	dbSetUp()
+	dbSetUp(t)
 	httpSetUp()
 	defer dbTearDown()
 	defer httpTearDown()
@@ -181,7 +183,7 @@ func TestTrackAPICall_NoParentCall(t *testing.T) {
 }
 
 func TestTrackAPICall_WithParentCallIDHeader(t *testing.T) {
-	dbSetUp()
+	dbSetUp(t)
 	httpSetUp()
 	defer dbTearDown()
 	defer httpTearDown()
@@ -231,3 +233,32 @@ func TestTrackAPICall_WithParentCallIDHeader(t *testing.T) {
 func makeParentCallIDHeader(id int64) string {
 	return fmt.Sprintf("%d", id)
 }
+
+func TestHandler_ClearsContext(t *testing.T) {
+	m := &Monitor{Live: &Hub{}}
+	r := httptest.NewRequest("GET", "/", nil)
+	m.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := getCall(r); !ok {
+			t.Error("no call while handling request")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	if vals := context.GetAll(r); len(vals) != 0 {
+		t.Errorf("got context values %v after request, want none", vals)
+	}
+}
+
+func TestAfterAPICall_ReleasesCall(t *testing.T) {
+	m := &Monitor{Live: &Hub{}}
+	r := httptest.NewRequest("GET", "/", nil)
+	defer context.Clear(r)
+	m.BeforeAPICall(r)
+	m.AfterAPICall(r, 0, http.StatusOK, "")
+
+	if _, ok := getCall(r); ok {
+		t.Error("want call removed from context after AfterAPICall")
+	}
+	if _, ok := GetCallID(r); !ok {
+		t.Error("want call ID kept after AfterAPICall")
+	}
+}
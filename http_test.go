@@ -39,7 +39,7 @@ func httpGet(t *testing.T, url string, callID int64) (res *http.Response) {
 	}
 
 	if callID != 0 {
-		addParentCallIDHeader(callID, req.Header)
+		InjectHeader(callID, req.Header)
 	}
 
 	res, err = http.DefaultClient.Do(req)
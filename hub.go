@@ -0,0 +1,142 @@
+package appmon
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Types of CallEvents.
+const (
+	CallStartedEvent  = "start"
+	CallFinishedEvent = "finish"
+)
+
+// A CallEvent is sent to Hub subscribers when a call starts or finishes.
+type CallEvent struct {
+	// Type is CallStartedEvent or CallFinishedEvent.
+	Type string
+
+	// Call is a copy of the call. Its CallStatus is only set for
+	// CallFinishedEvents.
+	Call Call
+}
+
+// A CallFilter selects calls. Its zero-valued fields match all calls.
+type CallFilter struct {
+	App    string
+	Route  string
+	UID    string // user ID
+	Tenant string
+
+	// Status is an HTTP status code (e.g., "404") or status class (e.g.,
+	// "5xx"). Because a call's status isn't known until it finishes, a
+	// nonempty Status only matches CallFinishedEvents.
+	Status string
+}
+
+// Match returns whether the event matches the filter.
+func (f *CallFilter) Match(e *CallEvent) bool {
+	c := &e.Call
+	if f.App != "" && f.App != c.App {
+		return false
+	}
+	if f.Route != "" && f.Route != c.Route {
+		return false
+	}
+	if f.UID != "" && (c.User == nil || f.UID != c.User.ID) {
+		return false
+	}
+	if f.Tenant != "" && (c.User == nil || f.Tenant != c.User.Tenant) {
+		return false
+	}
+	if f.Status != "" {
+		if e.Type != CallFinishedEvent {
+			return false
+		}
+		if f.Status != strconv.Itoa(c.HTTPStatusCode) && f.Status != statusClass(c.HTTPStatusCode) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Hub is an Observer that publishes call events to subscribers, such as the
+// panel's live tail.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// LiveCalls is the Hub that calls tracked without a Monitor (by the default
+// Monitors; see DefaultMonitor) are published to.
+var LiveCalls = &Hub{}
+
+// A Subscription receives the call events that match its filter.
+type Subscription struct {
+	// C is the channel that events are delivered on. It is closed when the
+	// subscription is canceled.
+	C <-chan CallEvent
+
+	c       chan CallEvent
+	filter  CallFilter
+	dropped int64
+}
+
+// Dropped returns the number of events that were dropped because the
+// subscriber wasn't keeping up.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Subscribe returns a new subscription to events matching f. Up to buffer
+// events are queued for the subscriber; events published while the queue is
+// full are dropped rather than blocking calls. Callers must call Unsubscribe
+// when they are done.
+func (h *Hub) Subscribe(f CallFilter, buffer int) *Subscription {
+	c := make(chan CallEvent, buffer)
+	s := &Subscription{C: c, c: c, filter: f}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[*Subscription]struct{})
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe cancels s and closes s.C.
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, present := h.subs[s]; present {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+// CallStarted implements Observer.
+func (h *Hub) CallStarted(c *Call) {
+	h.publish(&CallEvent{Type: CallStartedEvent, Call: *c})
+}
+
+// CallFinished implements Observer.
+func (h *Hub) CallFinished(c *Call) {
+	h.publish(&CallEvent{Type: CallFinishedEvent, Call: *c})
+}
+
+func (h *Hub) publish(e *CallEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.c <- *e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
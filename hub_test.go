@@ -0,0 +1,80 @@
+package appmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	h := &Hub{}
+	all := h.Subscribe(CallFilter{}, 10)
+	apiErrors := h.Subscribe(CallFilter{App: "api", Status: "5xx"}, 10)
+	defer h.Unsubscribe(all)
+	defer h.Unsubscribe(apiErrors)
+
+	ok := makeFinishedCall("api", "r", "GET", 200, time.Millisecond)
+	failed := makeFinishedCall("api", "r", "GET", 503, time.Millisecond)
+	other := makeFinishedCall("web", "r", "GET", 500, time.Millisecond)
+	for _, c := range []*Call{ok, failed, other} {
+		h.CallStarted(c)
+		h.CallFinished(c)
+	}
+
+	if want, got := 6, len(all.C); want != got {
+		t.Errorf("want %d events for unfiltered subscriber, got %d", want, got)
+	}
+	if e := <-all.C; e.Type != CallStartedEvent {
+		t.Errorf("want first event to be %q, got %q", CallStartedEvent, e.Type)
+	}
+
+	if want, got := 1, len(apiErrors.C); want != got {
+		t.Fatalf("want %d events for filtered subscriber, got %d", want, got)
+	}
+	if e := <-apiErrors.C; e.Type != CallFinishedEvent || e.Call.HTTPStatusCode != 503 {
+		t.Errorf("want finish event of failed call, got %+v", e)
+	}
+}
+
+func TestHub_SlowSubscriber(t *testing.T) {
+	h := &Hub{}
+	s := h.Subscribe(CallFilter{}, 1)
+	c := makeFinishedCall("api", "r", "GET", 200, time.Millisecond)
+	h.CallStarted(c)
+	h.CallFinished(c)
+
+	if want, got := int64(1), s.Dropped(); want != got {
+		t.Errorf("want %d dropped, got %d", want, got)
+	}
+	h.Unsubscribe(s)
+	if _, ok := <-s.C; !ok {
+		t.Error("want buffered event before close")
+	}
+	if _, ok := <-s.C; ok {
+		t.Error("want s.C closed after Unsubscribe")
+	}
+}
+
+func TestCallFilter_User(t *testing.T) {
+	c := makeFinishedCall("api", "r", "GET", 200, time.Millisecond)
+	anon := &CallEvent{Type: CallFinishedEvent, Call: *c}
+	c.User = &User{ID: "alice", Tenant: "acme"}
+	alice := &CallEvent{Type: CallFinishedEvent, Call: *c}
+
+	tests := []struct {
+		f    CallFilter
+		e    *CallEvent
+		want bool
+	}{
+		{CallFilter{UID: "alice"}, alice, true},
+		{CallFilter{UID: "bob"}, alice, false},
+		{CallFilter{UID: "alice"}, anon, false},
+		{CallFilter{Tenant: "acme"}, alice, true},
+		{CallFilter{Tenant: "other"}, alice, false},
+		{CallFilter{Tenant: "acme"}, anon, false},
+	}
+	for _, test := range tests {
+		if got := test.f.Match(test.e); got != test.want {
+			t.Errorf("%+v.Match(%+v): want %v, got %v", test.f, test.e.Call.User, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package export contains helpers shared by the span exporters.
+package export
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+)
+
+// Defaults for Batcher fields.
+const (
+	DefaultMaxBatch      = 100
+	DefaultMaxQueue      = 10000
+	DefaultFlushInterval = 5 * time.Second
+	DefaultMaxRetries    = 3
+	DefaultRetryBackoff  = 500 * time.Millisecond
+)
+
+// A Batcher queues finished calls and sends them in batches from a background
+// goroutine. The queue is bounded: calls added while it is full are dropped.
+type Batcher struct {
+	// Name identifies the batcher in log messages.
+	Name string
+
+	// Send sends a batch of calls. If it returns an error, the batch is
+	// retried up to MaxRetries times before being dropped.
+	Send func([]*appmon.Call) error
+
+	MaxBatch      int           // maximum number of calls per batch
+	MaxQueue      int           // maximum number of queued calls
+	FlushInterval time.Duration // how often partial batches are sent
+	MaxRetries    int           // number of retries of a failed batch
+	RetryBackoff  time.Duration // delay before the first retry (doubled after each retry)
+
+	mu      sync.Mutex
+	queue   []*appmon.Call
+	dropped int64
+	kick    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Start fills in defaults for unset fields and starts the background
+// goroutine.
+func (b *Batcher) Start() {
+	if b.MaxBatch == 0 {
+		b.MaxBatch = DefaultMaxBatch
+	}
+	if b.MaxQueue == 0 {
+		b.MaxQueue = DefaultMaxQueue
+	}
+	if b.FlushInterval == 0 {
+		b.FlushInterval = DefaultFlushInterval
+	}
+	if b.MaxRetries == 0 {
+		b.MaxRetries = DefaultMaxRetries
+	}
+	if b.RetryBackoff == 0 {
+		b.RetryBackoff = DefaultRetryBackoff
+	}
+	b.kick = make(chan struct{}, 1)
+	b.done = make(chan struct{})
+	b.wg.Add(1)
+	go b.loop()
+}
+
+// Add queues a copy of c.
+func (b *Batcher) Add(c *appmon.Call) {
+	c2 := *c
+
+	b.mu.Lock()
+	if len(b.queue) >= b.MaxQueue {
+		b.dropped++
+		b.mu.Unlock()
+		return
+	}
+	b.queue = append(b.queue, &c2)
+	full := len(b.queue) >= b.MaxBatch
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of calls dropped because the queue was full or
+// because sending them failed.
+func (b *Batcher) Dropped() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// Close sends all queued calls and stops the background goroutine.
+func (b *Batcher) Close() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+func (b *Batcher) loop() {
+	defer b.wg.Done()
+	t := time.NewTicker(b.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.kick:
+		case <-b.done:
+			for b.flush() {
+			}
+			return
+		}
+		for b.flush() {
+		}
+	}
+}
+
+// flush sends up to MaxBatch queued calls. It returns whether any calls were
+// sent (or dropped), so that callers can keep flushing until the queue is
+// empty.
+func (b *Batcher) flush() bool {
+	b.mu.Lock()
+	n := len(b.queue)
+	if n > b.MaxBatch {
+		n = b.MaxBatch
+	}
+	batch := b.queue[:n:n]
+	b.queue = b.queue[n:]
+	b.mu.Unlock()
+	if n == 0 {
+		return false
+	}
+
+	backoff := b.RetryBackoff
+	for try := 0; ; try++ {
+		err := b.Send(batch)
+		if err == nil {
+			return true
+		}
+		if try == b.MaxRetries {
+			log.Printf("%s: dropping %d calls after %d retries: %s", b.Name, len(batch), try, err)
+			b.mu.Lock()
+			b.dropped += int64(len(batch))
+			b.mu.Unlock()
+			return true
+		}
+		select {
+		case <-time.After(backoff):
+		case <-b.done:
+			// Shutting down; don't wait for the full backoff.
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,123 @@
+package export
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sourcegraph/appmon"
+)
+
+// maxTraces is the number of call IDs whose trace IDs a Traces remembers.
+const maxTraces = 10000
+
+// TraceID is a 128-bit trace ID.
+type TraceID [16]byte
+
+// DefaultNamespace returns the default namespace of the calls stored in s (or
+// in the Store of appmon.DefaultMonitor, if s is nil). Exporters derive span
+// and trace IDs from a call's ID and a namespace that identifies the Store it
+// is stored in, because call IDs are only unique within a Store. All processes
+// that store calls in the same Store must therefore use the same namespace.
+//
+// The namespace consists of the PG* environment variables that identify the
+// database (which appmon.OpenDB connects to) and the Store's schema. A Store
+// whose DB connects to another database needs an explicit namespace.
+func DefaultNamespace(s *appmon.Store) string {
+	schema := appmon.DBSchema
+	if s != nil {
+		schema = s.Schema
+	}
+	return strings.Join([]string{os.Getenv("PGHOST"), os.Getenv("PGPORT"), os.Getenv("PGDATABASE"), schema}, "/")
+}
+
+// Traces assigns trace and span IDs to calls. appmon only propagates parent
+// call IDs, so a call's trace is found by following its ancestors as they
+// start in this process. A call whose parent was handled by another process is
+// assigned the trace rooted at its parent; this is exact for the common case
+// of a root call that makes API calls to other processes.
+//
+// Call IDs are only unique within a Store, so IDs are derived from a call's ID
+// and Namespace, which identifies the Store. Calls with ID 0 (which weren't
+// stored) have no meaningful IDs and shouldn't be exported.
+type Traces struct {
+	// Namespace identifies the Store whose calls are exported. All processes
+	// that store calls in the same Store must use the same Namespace, so that
+	// their spans are linked.
+	Namespace string
+
+	mu    sync.Mutex
+	trace map[int64]TraceID
+	order []int64 // call IDs in trace, oldest first, for eviction
+}
+
+// SpanID returns the 64-bit span ID of the call with the given ID.
+func (t *Traces) SpanID(callID int64) [8]byte {
+	h := fnv.New64a()
+	t.hashID(h, "span", callID)
+	var id [8]byte
+	h.Sum(id[:0])
+	if id == ([8]byte{}) {
+		id[7] = 1 // all-zero span IDs are invalid
+	}
+	return id
+}
+
+// traceIDFor returns the trace ID of the trace rooted at the given call.
+func (t *Traces) traceIDFor(rootCallID int64) TraceID {
+	h := fnv.New128a()
+	t.hashID(h, "trace", rootCallID)
+	var id TraceID
+	h.Sum(id[:0])
+	if id == (TraceID{}) {
+		id[15] = 1 // all-zero trace IDs are invalid
+	}
+	return id
+}
+
+func (t *Traces) hashID(h hash.Hash, kind string, callID int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(callID))
+	h.Write([]byte(kind + "\x00" + t.Namespace + "\x00"))
+	h.Write(b[:])
+}
+
+// Start records the trace of a call that just started. It must be called
+// before any of the call's children start.
+func (t *Traces) Start(c *appmon.Call) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.trace == nil {
+		t.trace = make(map[int64]TraceID)
+	}
+	if len(t.order) >= maxTraces {
+		delete(t.trace, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.trace[c.ID] = t.lookup(c)
+	t.order = append(t.order, c.ID)
+}
+
+// TraceID returns the trace ID of c.
+func (t *Traces) TraceID(c *appmon.Call) TraceID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id, ok := t.trace[c.ID]; ok {
+		return id
+	}
+	return t.lookup(c)
+}
+
+// lookup determines c's trace ID from its parent. t.mu must be held.
+func (t *Traces) lookup(c *appmon.Call) TraceID {
+	if c.ParentCallID == 0 {
+		return t.traceIDFor(c.ID)
+	}
+	if id, ok := t.trace[int64(c.ParentCallID)]; ok {
+		return id
+	}
+	return t.traceIDFor(int64(c.ParentCallID))
+}
@@ -0,0 +1,64 @@
+package appmon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+	"strings"
+)
+
+// An IPAnonymizer is a Scrubber that anonymizes calls' RemoteAddr and
+// RemoteAddrChain, so that rough geography and abuse correlation are possible
+// without storing full IP addresses. Add it to Scrubbers to apply it in
+// BeforeAPICall.
+type IPAnonymizer struct {
+	// Key, if nonempty, is the HMAC-SHA256 key used to replace each address
+	// with a keyed hash of it, which allows correlating calls from the same
+	// address but not geolocation. Hashes are represented as IPv6 unique
+	// local addresses (in fd00::/8) so that they can be stored like other
+	// addresses.
+	//
+	// If Key is empty, addresses are truncated instead: IPv4 addresses to
+	// their /24 network and IPv6 addresses to their /48 network (e.g.,
+	// "1.2.3.4" becomes "1.2.3.0").
+	Key []byte
+}
+
+// Scrub implements Scrubber.
+func (a *IPAnonymizer) Scrub(c *Call) {
+	if ip := parseAddr(c.RemoteAddr); ip != nil {
+		c.RemoteAddr = a.anonymize(ip).String()
+	}
+	if c.RemoteAddrChain != "" {
+		hops := strings.Split(c.RemoteAddrChain, ",")
+		for i, hop := range hops {
+			if ip := parseAddr(strings.TrimSpace(hop)); ip != nil {
+				hops[i] = a.anonymize(ip).String()
+			} else {
+				hops[i] = strings.TrimSpace(hop)
+			}
+		}
+		c.RemoteAddrChain = strings.Join(hops, ", ")
+	}
+}
+
+// IPv4 and IPv6 network masks that IPAnonymizer truncates addresses to.
+var (
+	ipv4AnonMask = net.CIDRMask(24, 8*net.IPv4len)
+	ipv6AnonMask = net.CIDRMask(48, 8*net.IPv6len)
+)
+
+func (a *IPAnonymizer) anonymize(ip net.IP) net.IP {
+	if len(a.Key) > 0 {
+		mac := hmac.New(sha256.New, a.Key)
+		mac.Write(ip.To16())
+		h := make(net.IP, net.IPv6len)
+		h[0] = 0xfd
+		copy(h[1:], mac.Sum(nil))
+		return h
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(ipv4AnonMask)
+	}
+	return ip.Mask(ipv6AnonMask)
+}
@@ -0,0 +1,54 @@
+package appmon
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIPAnonymizer_Truncate(t *testing.T) {
+	a := &IPAnonymizer{}
+	c := &Call{
+		RemoteAddr:      "1.2.3.4",
+		RemoteAddrChain: "2001:db8:1234:5678::1, unknown, 10.0.0.1:5678",
+	}
+	a.Scrub(c)
+	if want := "1.2.3.0"; c.RemoteAddr != want {
+		t.Errorf("got RemoteAddr %q, want %q", c.RemoteAddr, want)
+	}
+	if want := "2001:db8:1234::, unknown, 10.0.0.0"; c.RemoteAddrChain != want {
+		t.Errorf("got RemoteAddrChain %q, want %q", c.RemoteAddrChain, want)
+	}
+
+	c = &Call{RemoteAddr: "2001:db8:1234:5678::1"}
+	a.Scrub(c)
+	if want := "2001:db8:1234::"; c.RemoteAddr != want {
+		t.Errorf("got RemoteAddr %q, want %q", c.RemoteAddr, want)
+	}
+}
+
+func TestIPAnonymizer_Hash(t *testing.T) {
+	a := &IPAnonymizer{Key: []byte("k")}
+	hash := func(addr string) string {
+		c := &Call{RemoteAddr: addr}
+		a.Scrub(c)
+		return c.RemoteAddr
+	}
+
+	h := hash("1.2.3.4")
+	if ip := net.ParseIP(h); ip == nil || !strings.HasPrefix(h, "fd") {
+		t.Errorf("got hash %q, want an address in fd00::/8", h)
+	}
+	if hash("1.2.3.4") != h {
+		t.Error("hashes of the same address differ")
+	}
+	if hash("1.2.3.5") == h {
+		t.Error("hashes of different addresses are equal")
+	}
+	if (&IPAnonymizer{Key: []byte("k2")}).anonymize(net.ParseIP("1.2.3.4")).String() == h {
+		t.Error("hashes with different keys are equal")
+	}
+	if hash("") != "" {
+		t.Error("empty RemoteAddr changed")
+	}
+}
@@ -0,0 +1,109 @@
+package appmon
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/sourcegraph/go-nnz/nnz"
+)
+
+// JobMethod is the HTTPMethod of calls that track jobs (see StartJob), which
+// distinguishes them from API calls.
+const JobMethod = "JOB"
+
+// HTTP status codes recorded for finished jobs, so that failed jobs are
+// treated like failed API calls (e.g., by the panel's failed calls filter).
+const (
+	jobSucceededStatus = http.StatusOK
+	jobFailedStatus    = http.StatusInternalServerError
+)
+
+// A Job tracks a unit of work that isn't an HTTP request, such as a
+// background job, cron task or queue message handler. Its call's Route is the
+// job name, its RouteParams are the job's arguments, and its HTTPMethod is
+// JobMethod.
+type Job struct {
+	m *Monitor
+	c *Call
+
+	mu       sync.Mutex
+	finished bool
+}
+
+// StartJob starts tracking a job named name (e.g., "send-welcome-email") with
+// the given arguments, using the default Monitor for app. See
+// Monitor.StartJob.
+func StartJob(app, name string, parentCallID int64, args Params) *Job {
+	return DefaultMonitor(app).StartJob(name, parentCallID, args)
+}
+
+// StartJob starts tracking a job named name (e.g., "send-welcome-email") with
+// the given arguments. If parentCallID is nonzero, the job is recorded as a
+// child of that call (e.g., the API call that enqueued the job), so it is
+// shown with the call in the panel. (Queue consumers can get the parent call
+// ID from the message's headers with Extract.) The caller must call Finish
+// when the job is done.
+//
+// Jobs are scrubbed by m.Scrubbers like API calls, but m.Sampler and
+// m.CurrentUser (which need an HTTP request) are not used.
+func (m *Monitor) StartJob(name string, parentCallID int64, args Params) *Job {
+	// Copy args, so that scrubbing the call and setting its fields doesn't
+	// modify the caller's map.
+	routeParams := make(Params, len(args))
+	for k, v := range args {
+		routeParams[k] = v
+	}
+	c := &Call{
+		ParentCallID: nnz.Int64(parentCallID),
+		HTTPMethod:   JobMethod,
+		Route:        name,
+		RouteParams:  routeParams,
+		QueryParams:  Params{},
+	}
+	m.StartCall(c)
+	return &Job{m: m, c: c}
+}
+
+// CallID returns the ID of the job's call. Pass it as the parent call ID to
+// calls made on behalf of the job (e.g., with TracingTransport) so that they
+// are recorded as the job's children.
+func (j *Job) CallID() int64 { return j.c.ID }
+
+// Finish records that the job finished, successfully if err is nil and with
+// the error err otherwise. Only the first call to Finish has an effect.
+func (j *Job) Finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.finished {
+		return
+	}
+	j.finished = true
+
+	s := CallStatus{HTTPStatusCode: jobSucceededStatus}
+	if err != nil {
+		s.HTTPStatusCode = jobFailedStatus
+		s.Err = nnz.String(err.Error())
+	}
+	j.m.FinishCall(j.c, s)
+}
+
+// RunJob runs f as a job named name with the given arguments, using the
+// default Monitor for app. See Monitor.RunJob.
+func RunJob(app, name string, parentCallID int64, args Params, f func(j *Job) error) error {
+	return DefaultMonitor(app).RunJob(name, parentCallID, args, f)
+}
+
+// RunJob runs f as a tracked job (see StartJob) and returns its error. If f
+// panics, the job is recorded as failed and the panic is propagated.
+func (m *Monitor) RunJob(name string, parentCallID int64, args Params, f func(j *Job) error) (err error) {
+	j := m.StartJob(name, parentCallID, args)
+	defer func() {
+		if v := recover(); v != nil {
+			j.Finish(fmt.Errorf("panic: %v", v))
+			panic(v)
+		}
+		j.Finish(err)
+	}()
+	return f(j)
+}
@@ -0,0 +1,99 @@
+package appmon
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMonitor_StartJob(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{App: "worker", Observers: []Observer{&obs}, Live: &Hub{}}
+
+	j := m.StartJob("send-email", 123, Params{"to": "alice"})
+	if j.CallID() == 0 {
+		t.Error("want nonzero CallID")
+	}
+	j.Finish(nil)
+	j.Finish(errors.New("ignored"))
+
+	if len(obs.calls) != 1 {
+		t.Fatalf("got %d calls, want 1", len(obs.calls))
+	}
+	c := obs.calls[0]
+	if !c.IsJob() || c.App != "worker" || c.Route != "send-email" || c.ParentCallID != 123 {
+		t.Errorf("bad call: %+v", c)
+	}
+	if want := (Params{"to": "alice"}); !reflect.DeepEqual(c.RouteParams, want) {
+		t.Errorf("got RouteParams %v, want %v", c.RouteParams, want)
+	}
+	if c.HTTPStatusCode != http.StatusOK || c.Err != "" || !c.End.Valid {
+		t.Errorf("bad status: %+v", c.CallStatus)
+	}
+}
+
+func TestMonitor_StartJob_ScrubsCopyOfArgs(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{Scrubbers: []Scrubber{NewPIIScrubber([]byte("k"))}, Observers: []Observer{&obs}, Live: &Hub{}}
+
+	args := Params{"token": "secret"}
+	m.StartJob("send-email", 0, args).Finish(nil)
+
+	if want := (Params{"token": "secret"}); !reflect.DeepEqual(args, want) {
+		t.Errorf("got args %v after StartJob, want them unchanged (%v)", args, want)
+	}
+	if v := obs.calls[0].RouteParams["token"]; v == "secret" {
+		t.Error("want job's token arg scrubbed")
+	}
+}
+
+func TestMonitor_RunJob(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{Observers: []Observer{&obs}, Live: &Hub{}}
+
+	wantErr := errors.New("failed")
+	if err := m.RunJob("job", 0, nil, func(j *Job) error { return wantErr }); err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("want panic to propagate")
+			}
+		}()
+		m.RunJob("job", 0, nil, func(j *Job) error { panic("boom") })
+	}()
+
+	if len(obs.calls) != 2 {
+		t.Fatalf("got %d calls, want 2", len(obs.calls))
+	}
+	for i, wantErr := range []string{"failed", "panic: boom"} {
+		c := obs.calls[i]
+		if c.HTTPStatusCode != http.StatusInternalServerError || string(c.Err) != wantErr {
+			t.Errorf("call %d: got status %d and error %q, want %d and %q", i, c.HTTPStatusCode, c.Err, http.StatusInternalServerError, wantErr)
+		}
+	}
+}
+
+func TestStartJob_Stored(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	parent := makeCall()
+	if err := defaultStore().insertCall(parent); err != nil {
+		t.Fatal("insertCall", err)
+	}
+	j := StartJob("worker", "send-email", parent.ID, Params{"to": "alice"})
+	j2 := StartJob("worker", "render-email", j.CallID(), nil)
+	j2.Finish(nil)
+	j.Finish(nil)
+
+	calls, err := QueryCalls(&CallQuery{TraceCallID: parent.ID, Sort: SortByID, Ascending: true})
+	if err != nil {
+		t.Fatal("QueryCalls", err)
+	}
+	if len(calls) != 3 || calls[1].ID != j.CallID() || !calls[1].IsJob() || int64(calls[1].ParentCallID) != parent.ID || calls[2].ID != j2.CallID() {
+		t.Errorf("got calls %+v, want parent, job and the job's child job", calls)
+	}
+}
@@ -0,0 +1,251 @@
+package appmon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default upper bounds (in seconds) of the call latency
+// histogram buckets. They match the Prometheus client libraries' defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultMaxSeries is the default maximum number of distinct label sets that
+// a Metrics keeps.
+const DefaultMaxSeries = 1000
+
+// overflowRoute is the route label value used for calls whose label set
+// would exceed Metrics.MaxSeries. Unlike a word such as "other", it isn't a
+// plausible route name, and it isn't a path or ServeMux pattern.
+const overflowRoute = "_overflow"
+
+// Metrics is an Observer that keeps in-process call counters and latency
+// histograms, labelled by app, route, HTTP method and status class (e.g.,
+// "2xx"). It implements http.Handler and serves the metrics in the Prometheus
+// text exposition format.
+//
+// To use it, add it to Observers and mount it on a route that Prometheus
+// scrapes:
+//
+//	m := &appmon.Metrics{}
+//	appmon.Observers = append(appmon.Observers, m)
+//	http.Handle("/metrics", m)
+type Metrics struct {
+	// Buckets are the upper bounds (in seconds) of the latency histogram
+	// buckets, in increasing order. If nil, DefaultBuckets is used.
+	Buckets []float64
+
+	// MaxSeries is the maximum number of distinct (app, route, method, status)
+	// label sets to keep. Once it is reached, calls that would add a new label
+	// set are counted under the route "_overflow" instead. If zero,
+	// DefaultMaxSeries is used.
+	MaxSeries int
+
+	mu       sync.Mutex
+	series   map[seriesKey]*series
+	inFlight map[string]int64 // app -> number of unfinished calls
+	overflow int64            // number of calls counted under overflowRoute
+}
+
+type seriesKey struct {
+	app, route, method, status string
+}
+
+type series struct {
+	count   int64
+	sum     float64 // seconds
+	buckets []int64 // non-cumulative counts, one per bucket
+}
+
+// CallStarted implements Observer.
+func (m *Metrics) CallStarted(c *Call) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inFlight == nil {
+		m.inFlight = make(map[string]int64)
+	}
+	m.inFlight[c.App]++
+}
+
+// CallFinished implements Observer.
+func (m *Metrics) CallFinished(c *Call) {
+	k := seriesKey{
+		app:    c.App,
+		route:  c.Route,
+		method: metricsMethod(c.HTTPMethod),
+		status: statusClass(c.HTTPStatusCode),
+	}
+	secs := c.Duration().Seconds()
+	buckets := m.buckets()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inFlight[c.App] > 0 {
+		m.inFlight[c.App]--
+	}
+	if m.series == nil {
+		m.series = make(map[seriesKey]*series)
+	}
+	s, present := m.series[k]
+	if !present {
+		if len(m.series) >= m.maxSeries() {
+			k.route = overflowRoute
+			m.overflow++
+			s = m.series[k]
+		}
+		if s == nil {
+			s = &series{buckets: make([]int64, len(buckets))}
+			m.series[k] = s
+		}
+	}
+	s.count++
+	s.sum += secs
+	for i, le := range buckets {
+		if secs <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *Metrics) buckets() []float64 {
+	if m.Buckets == nil {
+		return DefaultBuckets
+	}
+	return m.Buckets
+}
+
+func (m *Metrics) maxSeries() int {
+	if m.MaxSeries == 0 {
+		return DefaultMaxSeries
+	}
+	return m.MaxSeries
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format to w.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]seriesKey, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Sort(seriesKeys(keys))
+
+	var b strings.Builder
+	b.WriteString("# HELP appmon_calls_total Total number of finished calls.\n")
+	b.WriteString("# TYPE appmon_calls_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "appmon_calls_total{%s} %d\n", k.labels(), m.series[k].count)
+	}
+
+	b.WriteString("# HELP appmon_call_duration_seconds Duration of finished calls.\n")
+	b.WriteString("# TYPE appmon_call_duration_seconds histogram\n")
+	for _, k := range keys {
+		s, labels := m.series[k], k.labels()
+		var cum int64
+		for i, le := range m.buckets() {
+			cum += s.buckets[i]
+			fmt.Fprintf(&b, "appmon_call_duration_seconds_bucket{%s,le=%q} %d\n", labels, formatFloat(le), cum)
+		}
+		fmt.Fprintf(&b, "appmon_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.count)
+		fmt.Fprintf(&b, "appmon_call_duration_seconds_sum{%s} %s\n", labels, formatFloat(s.sum))
+		fmt.Fprintf(&b, "appmon_call_duration_seconds_count{%s} %d\n", labels, s.count)
+	}
+
+	apps := make([]string, 0, len(m.inFlight))
+	for app := range m.inFlight {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	b.WriteString("# HELP appmon_calls_in_flight Number of calls currently being handled.\n")
+	b.WriteString("# TYPE appmon_calls_in_flight gauge\n")
+	for _, app := range apps {
+		fmt.Fprintf(&b, "appmon_calls_in_flight{app=\"%s\"} %d\n", escapeLabelValue(app), m.inFlight[app])
+	}
+
+	b.WriteString("# HELP appmon_metrics_overflow_total Number of calls counted under the \"_overflow\" route because MaxSeries was reached.\n")
+	b.WriteString("# TYPE appmon_metrics_overflow_total counter\n")
+	fmt.Fprintf(&b, "appmon_metrics_overflow_total %d\n", m.overflow)
+
+	truncations := Truncations()
+	columns := make([]string, 0, len(truncations))
+	for column := range truncations {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	b.WriteString("# HELP appmon_truncated_fields_total Number of call field values truncated because they were too long to store.\n")
+	b.WriteString("# TYPE appmon_truncated_fields_total counter\n")
+	for _, column := range columns {
+		fmt.Fprintf(&b, "appmon_truncated_fields_total{field=\"%s\"} %d\n", column, truncations[column])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (k seriesKey) labels() string {
+	return fmt.Sprintf(`app="%s",route="%s",method="%s",status="%s"`,
+		escapeLabelValue(k.app), escapeLabelValue(k.route), escapeLabelValue(k.method), k.status)
+}
+
+type seriesKeys []seriesKey
+
+func (v seriesKeys) Len() int      { return len(v) }
+func (v seriesKeys) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v seriesKeys) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.app != b.app {
+		return a.app < b.app
+	}
+	if a.route != b.route {
+		return a.route < b.route
+	}
+	if a.method != b.method {
+		return a.method < b.method
+	}
+	return a.status < b.status
+}
+
+// metricsMethods are the HTTP methods that get their own label value. Others
+// are counted as "OTHER" so that clients can't create arbitrary series.
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+func metricsMethod(method string) string {
+	if metricsMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// statusClass returns the class of an HTTP status code (e.g., "2xx" for 204).
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "0xx"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
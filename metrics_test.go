@@ -0,0 +1,84 @@
+package appmon
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeFinishedCall(app, route, method string, code int, d time.Duration) *Call {
+	start := time.Now()
+	return &Call{
+		App:        app,
+		Route:      route,
+		HTTPMethod: method,
+		Start:      start,
+		CallStatus: CallStatus{
+			End:            NullTime{Time: start.Add(d), Valid: true},
+			HTTPStatusCode: code,
+		},
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := &Metrics{Buckets: []float64{0.1, 1}}
+
+	c1 := makeFinishedCall("api", "get-user", "GET", 200, 50*time.Millisecond)
+	c2 := makeFinishedCall("api", "get-user", "GET", 204, 500*time.Millisecond)
+	c3 := makeFinishedCall("api", "get-user", "BREW", 503, 2*time.Second)
+	for _, c := range []*Call{c1, c2, c3} {
+		m.CallStarted(c)
+	}
+	m.CallFinished(c1)
+	m.CallFinished(c2)
+
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, nil)
+	out := rw.Body.String()
+
+	want := []string{
+		`appmon_calls_total{app="api",route="get-user",method="GET",status="2xx"} 2`,
+		`appmon_call_duration_seconds_bucket{app="api",route="get-user",method="GET",status="2xx",le="0.1"} 1`,
+		`appmon_call_duration_seconds_bucket{app="api",route="get-user",method="GET",status="2xx",le="1"} 2`,
+		`appmon_call_duration_seconds_bucket{app="api",route="get-user",method="GET",status="2xx",le="+Inf"} 2`,
+		`appmon_call_duration_seconds_count{app="api",route="get-user",method="GET",status="2xx"} 2`,
+		`appmon_calls_in_flight{app="api"} 1`,
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w+"\n") {
+			t.Errorf("want output to contain %q, got:\n%s", w, out)
+		}
+	}
+
+	m.CallFinished(c3)
+	rw = httptest.NewRecorder()
+	m.ServeHTTP(rw, nil)
+	if w := `appmon_calls_total{app="api",route="get-user",method="OTHER",status="5xx"} 1`; !strings.Contains(rw.Body.String(), w) {
+		t.Errorf("want output to contain %q, got:\n%s", w, rw.Body.String())
+	}
+}
+
+func TestMetrics_MaxSeries(t *testing.T) {
+	m := &Metrics{MaxSeries: 2}
+	// A real route named "other" isn't merged with the overflow series.
+	for _, route := range []string{"other", "b", "c", "d", "other"} {
+		m.CallFinished(makeFinishedCall("api", route, "GET", 200, time.Millisecond))
+	}
+
+	if len(m.series) != 3 {
+		t.Errorf("want 3 series (2 + overflow), got %d", len(m.series))
+	}
+	if got := m.series[seriesKey{"api", "other", "GET", "2xx"}].count; got != 2 {
+		t.Errorf("want route other count == 2, got %d", got)
+	}
+	if got := m.series[seriesKey{"api", "_overflow", "GET", "2xx"}].count; got != 2 {
+		t.Errorf("want overflow count == 2, got %d", got)
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	if want, got := `a\"b\\c\nd`, escapeLabelValue("a\"b\\c\nd"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
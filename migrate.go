@@ -0,0 +1,539 @@
+package appmon
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A Migration is a forward change to the database schema. Migrations are
+// applied in order of Version, and each is applied at most once.
+type Migration struct {
+	// Version is the schema version after the migration is applied.
+	Version int
+
+	// Name describes the migration.
+	Name string
+
+	// SQL returns the SQL statements of the migration, given the
+	// double-quoted name of the database schema. They run in a single
+	// transaction.
+	SQL func(schema string) string `json:"-"`
+
+	// NoTxSQL, if set instead of SQL, returns the SQL statements of a
+	// migration that must run outside of a transaction, such as CREATE INDEX
+	// CONCURRENTLY (which builds an index without blocking writes to the
+	// table). Each statement runs and commits separately. Since a failed
+	// migration may have been partially applied, each statement must be
+	// safe to rerun.
+	NoTxSQL func(schema string) []string `json:"-"`
+}
+
+// MigrationLockTimeout is how long a migration waits to acquire a lock (e.g.,
+// on the call table) before failing. Statements that wait for a lock on a
+// table block all later queries on it, including inserting tracked calls, so
+// a migration fails rather than wait long while the table is busy; it can be
+// retried later.
+var MigrationLockTimeout = 10 * time.Second
+
+// migrations are all of the schema migrations, ordered by Version. New
+// migrations must be appended; existing migrations must never be changed,
+// since they may already have been applied.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create call table",
+		SQL: func(schema string) string {
+			return `
+CREATE TABLE IF NOT EXISTS ` + schema + `.call (
+  id bigserial NOT NULL,
+  parent_call_id bigint,
+
+  app varchar(24) NOT NULL,
+  host varchar(32) NOT NULL,
+
+  remote_addr varchar(24) NOT NULL,
+  user_agent varchar(500) NOT NULL,
+  uid int NULL,
+
+  url varchar(1000) NOT NULL,
+  http_method varchar(12) NOT NULL,
+  route varchar(64) NULL,
+  route_params varchar(1000) NOT NULL,
+  query_params varchar(1000) NOT NULL,
+
+  start timestamp(3) NOT NULL,
+
+  -- call status fields (filled in post-request)
+  "end" timestamp(3),
+  body_length int,
+  http_status_code int,
+  err text,
+
+  CONSTRAINT call_pkey PRIMARY KEY (id)
+);
+`
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add call indexes for panel queries",
+		NoTxSQL: func(schema string) []string {
+			return concat(
+				createIndexConcurrently(schema, "call_app_route_start", `call (app, route, "start")`),
+				createIndexConcurrently(schema, "call_parent_call_id", `call (parent_call_id) WHERE parent_call_id IS NOT NULL`),
+				createIndexConcurrently(schema, "call_start", `call ("start")`),
+				createIndexConcurrently(schema, "call_failed_start", `call ("start") WHERE http_status_code < 200 OR http_status_code >= 400`),
+			)
+		},
+	},
+	{
+		Version: 3,
+		Name:    "store remote_addr as inet and add remote_addr_chain",
+		NoTxSQL: func(schema string) []string {
+			// Existing remote_addr values were stored verbatim from
+			// http.Request.RemoteAddr (host:port), possibly truncated.
+			// Values that aren't valid addresses become NULL.
+			//
+			// Rather than rewriting the call table while holding a
+			// lock on it (which ALTER COLUMN TYPE does), an inet column
+			// is added, backfilled in batches and swapped in. The steps
+			// are skipped once remote_addr is an inet column.
+			notInet := callColumnType(schema, "remote_addr") + ` <> 'inet'::regtype`
+			parsed := `remote_addr_inet = pg_temp.appmon_parse_inet(remote_addr)`
+			pending := `remote_addr_inet IS NULL AND remote_addr IS NOT NULL`
+			return []string{`
+CREATE OR REPLACE FUNCTION pg_temp.appmon_parse_inet(s text) RETURNS inet AS $$
+BEGIN
+  IF s ~ '^\[.*\]:[0-9]+$' THEN
+    s := substring(s from '^\[(.*)\]');
+  ELSIF s ~ '^[0-9.]+:[0-9]+$' THEN
+    s := split_part(s, ':', 1);
+  END IF;
+  RETURN s::inet;
+EXCEPTION WHEN others THEN
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+				`ALTER TABLE ` + schema + `.call ADD COLUMN IF NOT EXISTS remote_addr_chain text`,
+				`
+DO $$
+BEGIN
+  IF ` + notInet + ` THEN
+    ALTER TABLE ` + schema + `.call ADD COLUMN IF NOT EXISTS remote_addr_inet inet;
+  END IF;
+END
+$$`,
+				backfillCall(schema, notInet, parsed, pending),
+				`
+DO $$
+BEGIN
+  IF ` + notInet + ` THEN
+    UPDATE ` + schema + `.call SET ` + parsed + ` WHERE ` + pending + `;
+    ALTER TABLE ` + schema + `.call DROP COLUMN remote_addr;
+    ALTER TABLE ` + schema + `.call RENAME COLUMN remote_addr_inet TO remote_addr;
+  END IF;
+END
+$$`,
+			}
+		},
+	},
+	{
+		Version: 4,
+		Name:    "store call url, user_agent and params as text",
+		SQL: func(schema string) string {
+			return `
+ALTER TABLE ` + schema + `.call
+  ALTER COLUMN url TYPE text,
+  ALTER COLUMN user_agent TYPE text,
+  ALTER COLUMN route_params TYPE text,
+  ALTER COLUMN query_params TYPE text;
+`
+		},
+	},
+	{
+		// Migrations 5-8 convert the params columns to jsonb without
+		// rewriting the call table while holding a lock on it (which
+		// ALTER COLUMN TYPE does): new columns are added and backfilled
+		// in batches, then swapped in.
+		Version: 5,
+		Name:    "add jsonb call params columns",
+		SQL: func(schema string) string {
+			return `
+ALTER TABLE ` + schema + `.call
+  ADD COLUMN IF NOT EXISTS route_params_jsonb jsonb,
+  ADD COLUMN IF NOT EXISTS query_params_jsonb jsonb;
+`
+		},
+	},
+	{
+		Version: 6,
+		Name:    "backfill jsonb call params columns",
+		NoTxSQL: func(schema string) []string {
+			// Each batch is committed, so locks on the updated rows are
+			// held briefly and the backfill resumes where it left off
+			// if it's interrupted.
+			return []string{`
+DO $$
+DECLARE
+  lo bigint;
+  hi bigint;
+BEGIN
+  SELECT MIN(id), MAX(id) INTO lo, hi FROM ` + schema + `.call WHERE route_params_jsonb IS NULL;
+  WHILE lo <= hi LOOP
+    UPDATE ` + schema + `.call
+      SET route_params_jsonb = route_params::jsonb, query_params_jsonb = query_params::jsonb
+      WHERE id >= lo AND id < lo + 10000 AND route_params_jsonb IS NULL;
+    COMMIT;
+    lo := lo + 10000;
+  END LOOP;
+END
+$$`}
+		},
+	},
+	{
+		Version: 7,
+		Name:    "swap in jsonb call params columns",
+		SQL: func(schema string) string {
+			// Calls inserted during the backfill are converted here. The
+			// NOT NULL constraints of the old columns are replaced by
+			// constraints that aren't validated, which doesn't require
+			// scanning the table.
+			return `
+UPDATE ` + schema + `.call
+  SET route_params_jsonb = route_params::jsonb, query_params_jsonb = query_params::jsonb
+  WHERE route_params_jsonb IS NULL;
+ALTER TABLE ` + schema + `.call DROP COLUMN route_params, DROP COLUMN query_params;
+ALTER TABLE ` + schema + `.call RENAME COLUMN route_params_jsonb TO route_params;
+ALTER TABLE ` + schema + `.call RENAME COLUMN query_params_jsonb TO query_params;
+ALTER TABLE ` + schema + `.call
+  ADD CONSTRAINT call_route_params_not_null CHECK (route_params IS NOT NULL) NOT VALID,
+  ADD CONSTRAINT call_query_params_not_null CHECK (query_params IS NOT NULL) NOT VALID;
+`
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add call params indexes",
+		NoTxSQL: func(schema string) []string {
+			return concat(
+				createIndexConcurrently(schema, "call_route_params", `call USING gin (route_params jsonb_path_ops)`),
+				createIndexConcurrently(schema, "call_query_params", `call USING gin (query_params jsonb_path_ops)`),
+			)
+		},
+	},
+	{
+		Version: 9,
+		Name:    "store string user IDs and user tenant, name and roles",
+		NoTxSQL: func(schema string) []string {
+			// Like migration 3, uid is converted to text by adding a
+			// column, backfilling it in batches and swapping it in.
+			notText := callColumnType(schema, "uid") + ` <> 'text'::regtype`
+			converted := `uid_text = uid::text`
+			pending := `uid_text IS NULL AND uid IS NOT NULL`
+			return concat(
+				[]string{
+					`
+ALTER TABLE ` + schema + `.call
+  ADD COLUMN IF NOT EXISTS user_name text,
+  ADD COLUMN IF NOT EXISTS tenant text,
+  ADD COLUMN IF NOT EXISTS user_roles text[]`,
+					`
+DO $$
+BEGIN
+  IF ` + notText + ` THEN
+    ALTER TABLE ` + schema + `.call ADD COLUMN IF NOT EXISTS uid_text text;
+  END IF;
+END
+$$`,
+					backfillCall(schema, notText, converted, pending),
+					`
+DO $$
+BEGIN
+  IF ` + notText + ` THEN
+    UPDATE ` + schema + `.call SET ` + converted + ` WHERE ` + pending + `;
+    ALTER TABLE ` + schema + `.call DROP COLUMN uid;
+    ALTER TABLE ` + schema + `.call RENAME COLUMN uid_text TO uid;
+  END IF;
+END
+$$`,
+				},
+				createIndexConcurrently(schema, "call_uid_start", `call (uid, "start") WHERE uid IS NOT NULL`),
+				createIndexConcurrently(schema, "call_tenant_start", `call (tenant, "start") WHERE tenant IS NOT NULL`),
+			)
+		},
+	},
+	{
+		Version: 10,
+		Name:    "create privacy audit log",
+		SQL: func(schema string) string {
+			return `
+CREATE TABLE IF NOT EXISTS ` + schema + `.privacy_audit (
+  id bigserial NOT NULL,
+  operation text NOT NULL,
+  uid text NOT NULL,
+  actor text NOT NULL,
+  calls bigint NOT NULL,
+  "time" timestamp(3) NOT NULL,
+  CONSTRAINT privacy_audit_pkey PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS privacy_audit_uid ON ` + schema + `.privacy_audit (uid);
+`
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add call tags",
+		SQL: func(schema string) string {
+			return `
+ALTER TABLE ` + schema + `.call ADD COLUMN tags jsonb;
+`
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add call tags index",
+		NoTxSQL: func(schema string) []string {
+			return createIndexConcurrently(schema, "call_tags", `call USING gin (tags jsonb_path_ops)`)
+		},
+	},
+	{
+		Version: 13,
+		Name:    "add call log",
+		SQL: func(schema string) string {
+			return `
+ALTER TABLE ` + schema + `.call ADD COLUMN log text[];
+`
+		},
+	},
+}
+
+// createIndexConcurrently returns the statements that create the index named
+// index on def (e.g., `call ("start")`) in schema without blocking writes to
+// the table. If a previous attempt failed and left an invalid index behind,
+// it is dropped first.
+func createIndexConcurrently(schema, index, def string) []string {
+	return []string{`
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_index WHERE indexrelid = to_regclass('` + schema + `.` + index + `') AND NOT indisvalid) THEN
+    DROP INDEX ` + schema + `.` + index + `;
+  END IF;
+END
+$$`,
+		`CREATE INDEX CONCURRENTLY IF NOT EXISTS ` + index + ` ON ` + schema + `.` + def,
+	}
+}
+
+// callColumnType returns an SQL expression for the type (a regtype) of the
+// column of the call table in schema.
+func callColumnType(schema, column string) string {
+	return `(SELECT atttypid::regtype FROM pg_attribute WHERE attrelid = to_regclass('` + schema + `.call') AND attname = '` + column + `' AND NOT attisdropped)`
+}
+
+// backfillCall returns a statement that, if cond holds, applies set (e.g.,
+// "a_new = a::newtype") to the rows of the call table in schema that match
+// pending, in batches. Each batch is committed, so locks on the updated rows
+// are held briefly and the backfill resumes where it left off if it's
+// interrupted. It must run outside of a transaction.
+func backfillCall(schema, cond, set, pending string) string {
+	return `
+DO $$
+DECLARE
+  lo bigint;
+  hi bigint;
+BEGIN
+  IF ` + cond + ` THEN
+    SELECT MIN(id), MAX(id) INTO lo, hi FROM ` + schema + `.call WHERE ` + pending + `;
+    WHILE lo <= hi LOOP
+      UPDATE ` + schema + `.call SET ` + set + `
+        WHERE id >= lo AND id < lo + 10000 AND ` + pending + `;
+      COMMIT;
+      lo := lo + 10000;
+    END LOOP;
+  END IF;
+END
+$$`
+}
+
+// concat returns the concatenation of lists of statements.
+func concat(stmts ...[]string) []string {
+	var all []string
+	for _, s := range stmts {
+		all = append(all, s...)
+	}
+	return all
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database schema, or 0 if none have been applied.
+func (s *Store) SchemaVersion() (version int, err error) {
+	var exists bool
+	err = s.DB.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, `"`+s.Schema+`".schema_migrations`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	err = s.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM "` + s.Schema + `".schema_migrations`).Scan(&version)
+	return
+}
+
+// PendingMigrations returns the migrations that have not yet been applied to
+// the database schema.
+func (s *Store) PendingMigrations() ([]Migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return migrationsAfter(version), nil
+}
+
+func migrationsAfter(version int) []Migration {
+	for i, m := range migrations {
+		if m.Version > version {
+			return migrations[i:]
+		}
+	}
+	return nil
+}
+
+// Migrate applies all pending migrations to the database schema, which must
+// exist. It is safe to call concurrently from multiple processes: each
+// migration is applied in its own transaction (or, for migrations that can't
+// run in a transaction, while holding an advisory lock), and migrations that
+// have already been applied are skipped.
+func (s *Store) Migrate() error {
+	_, err := s.DB.Exec(`
+CREATE TABLE IF NOT EXISTS "` + s.Schema + `".schema_migrations (
+  version int NOT NULL,
+  name text NOT NULL,
+  applied_at timestamp(3) NOT NULL,
+  CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+)`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := s.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies m if it hasn't already been applied.
+func (s *Store) applyMigration(m Migration) error {
+	if m.NoTxSQL != nil {
+		return s.applyNoTxMigration(m)
+	}
+	return s.inTx(func(dbh DBH) error {
+		// Serialize concurrent migrators. The lock is held until the
+		// transaction ends.
+		_, err := dbh.Exec(`LOCK TABLE "` + s.Schema + `".schema_migrations IN EXCLUSIVE MODE`)
+		if err != nil {
+			return err
+		}
+		_, err = dbh.Exec(`SET LOCAL lock_timeout = ` + lockTimeoutMillis())
+		if err != nil {
+			return err
+		}
+
+		var applied bool
+		err = dbh.QueryRow(`SELECT EXISTS(SELECT 1 FROM "`+s.Schema+`".schema_migrations WHERE version = $1)`, m.Version).Scan(&applied)
+		if err != nil || applied {
+			return err
+		}
+
+		_, err = dbh.Exec(m.SQL(`"` + s.Schema + `"`))
+		if err != nil {
+			return err
+		}
+		_, err = dbh.Exec(`INSERT INTO "`+s.Schema+`".schema_migrations(version, name, applied_at) VALUES($1, $2, $3)`, m.Version, m.Name, time.Now().In(time.UTC))
+		return err
+	})
+}
+
+// applyNoTxMigration applies m, whose statements run outside of a
+// transaction, if it hasn't already been applied. Concurrent migrators are
+// serialized by a session-level advisory lock, which requires a dedicated
+// connection. If s.DB isn't a *sql.DB (e.g., it's a transaction), the
+// statements run on it directly, which fails for statements that can't run
+// in a transaction.
+func (s *Store) applyNoTxMigration(m Migration) (err error) {
+	dbh := s.DB
+	if db, ok := s.DB.(*sql.DB); ok {
+		ctx := context.Background()
+		var conn *sql.Conn
+		conn, err = db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		dbh = connDBH{ctx, conn}
+
+		_, err = dbh.Exec(`SELECT pg_advisory_lock(hashtext($1))`, s.Schema+".schema_migrations")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_, unlockErr := dbh.Exec(`SELECT pg_advisory_unlock(hashtext($1))`, s.Schema+".schema_migrations")
+			if err == nil {
+				err = unlockErr
+			}
+		}()
+
+		// The connection is returned to the pool afterwards, so the
+		// setting is reset.
+		_, err = dbh.Exec(`SET lock_timeout = ` + lockTimeoutMillis())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_, resetErr := dbh.Exec(`RESET lock_timeout`)
+			if err == nil {
+				err = resetErr
+			}
+		}()
+	}
+
+	var applied bool
+	err = dbh.QueryRow(`SELECT EXISTS(SELECT 1 FROM "`+s.Schema+`".schema_migrations WHERE version = $1)`, m.Version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	for _, stmt := range m.NoTxSQL(`"` + s.Schema + `"`) {
+		_, err = dbh.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dbh.Exec(`INSERT INTO "`+s.Schema+`".schema_migrations(version, name, applied_at) VALUES($1, $2, $3)`, m.Version, m.Name, time.Now().In(time.UTC))
+	return err
+}
+
+// connDBH is a DBH for a single database connection.
+type connDBH struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (c connDBH) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.conn.ExecContext(c.ctx, query, args...)
+}
+
+func (c connDBH) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(c.ctx, query, args...)
+}
+
+func (c connDBH) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.conn.QueryRowContext(c.ctx, query, args...)
+}
+
+// lockTimeoutMillis returns MigrationLockTimeout in milliseconds, the unit of
+// the lock_timeout setting.
+func lockTimeoutMillis() string {
+	return strconv.FormatInt(int64(MigrationLockTimeout/time.Millisecond), 10)
+}
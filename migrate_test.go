@@ -0,0 +1,56 @@
+package appmon
+
+import (
+	"testing"
+)
+
+func TestMigrations_Ordered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q: want version %d, got %d", m.Name, i+1, m.Version)
+		}
+	}
+}
+
+func TestMigrations_SQL(t *testing.T) {
+	for _, m := range migrations {
+		if (m.SQL == nil) == (m.NoTxSQL == nil) {
+			t.Errorf("migration %d: want exactly one of SQL and NoTxSQL", m.Version)
+		}
+	}
+}
+
+func TestMigrationsAfter(t *testing.T) {
+	if got := migrationsAfter(0); len(got) != len(migrations) {
+		t.Errorf("want all %d migrations pending, got %d", len(migrations), len(got))
+	}
+	if got := migrationsAfter(len(migrations)); len(got) != 0 {
+		t.Errorf("want no migrations pending, got %d", len(got))
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	// Migrating again is a no-op.
+	if err := MigrateDB(); err != nil {
+		t.Fatal("MigrateDB", err)
+	}
+
+	version, err := SchemaVersion()
+	if err != nil {
+		t.Fatal("SchemaVersion", err)
+	}
+	if want := migrations[len(migrations)-1].Version; version != want {
+		t.Errorf("want schema version %d, got %d", want, version)
+	}
+
+	pending, err := PendingMigrations()
+	if err != nil {
+		t.Fatal("PendingMigrations", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("want no pending migrations, got %d", len(pending))
+	}
+}
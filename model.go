@@ -19,40 +19,71 @@ type Call struct {
 	// Host is the physical machine that handled this call.
 	Host string
 
-	// RemoteAddr is the client's IP address, in dotted string notation (e.g., "1.2.3.4").
+	// RemoteAddr is the client's IP address (e.g., "1.2.3.4" or "2001:db8::1").
+	// If the request was forwarded by a trusted proxy (see TrustedProxies), it
+	// is the address of the client that the proxy reported.
 	RemoteAddr string
 
+	// RemoteAddrChain is the list of addresses that the request was forwarded
+	// through, from the original client to the immediate peer, as reported by
+	// the Forwarded, X-Forwarded-For or X-Real-IP headers and the connection
+	// (e.g., "1.2.3.4, 10.0.0.1, 10.0.0.2:5678"). It is empty if the request
+	// had no forwarding headers.
+	RemoteAddrChain string
+
 	// UserAgent is the client's User-Agent string.
 	UserAgent string
 
-	// UID is the user ID of the authenticated user, if any.
-	UID nnz.Int
+	// User is the authenticated user, or nil if the user is anonymous.
+	User *User
 
 	// URL is the full URL of the request.
 	URL string
 
-	// HTTPMethod is the HTTP method of the request (GET, POST, etc.).
+	// HTTPMethod is the HTTP method of the request (GET, POST, etc.), or
+	// JobMethod if the call tracks a job.
 	HTTPMethod string
 
-	// Route is the name of the route used to handle this request.
+	// Route is the name of the route used to handle this request, or the job
+	// name if the call tracks a job.
 	Route string
 
-	// RouteParams is a map of the route parameters in the request.
+	// RouteParams is a map of the route parameters in the request, or the
+	// job's arguments if the call tracks a job.
 	RouteParams Params
 
 	// QueryParams is a map of the querystring parameters in the request.
 	QueryParams Params
 
+	// Tags are custom key/value pairs that the application attached to the
+	// call (see SetTag), for filtering and grouping calls by
+	// application-specific attributes (e.g., the feature flag variant or
+	// the customer plan).
+	Tags Params
+
 	// Start is when the request began.
 	Start time.Time
 
 	CallStatus
+
+	// Log is the log lines captured while the call was handled, if it
+	// failed or was slow (see LogCapture).
+	Log []string `json:",omitempty"`
+
+	// logs buffers the call's log lines while it's being handled, if its
+	// Monitor captures logs.
+	logs *logBuffer
 }
 
 func (c *Call) Duration() time.Duration {
 	return c.End.Time.Sub(c.Start)
 }
 
+// IsJob returns whether c tracks a job (see StartJob) rather than an API call.
+func (c *Call) IsJob() bool {
+	return c.HTTPMethod == JobMethod
+}
+
 type CallStatus struct {
 	// End is when the request was finished processing.
 	End NullTime
@@ -67,5 +98,20 @@ type CallStatus struct {
 	Err nnz.String
 }
 
+// A User is an authenticated user of an application.
+type User struct {
+	// ID is the unique ID of the user (e.g., "123" or "alice@example.com").
+	ID string
+
+	// Name is the user's display name.
+	Name string `json:",omitempty"`
+
+	// Tenant is the organization or tenant that the user belongs to, if any.
+	Tenant string `json:",omitempty"`
+
+	// Roles are the user's roles or permissions (e.g., "admin").
+	Roles []string `json:",omitempty"`
+}
+
 // Params is a map of parameters for states and calls.
 type Params map[string]interface{}
@@ -0,0 +1,229 @@
+package appmon
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A Monitor tracks API calls and stores them (if it has a Store) and reports
+// them to its Observers. Each Monitor is configured independently, so one
+// process can run multiple Monitors (e.g., with a separate database schema
+// per sub-application).
+//
+// The package-level functions (BeforeAPICall, AfterAPICall, TrackAPICall)
+// use a default Monitor configured by the package-level variables (see
+// DefaultMonitor).
+//
+// A Monitor's fields should be set before it tracks any calls.
+type Monitor struct {
+	// Store stores tracked calls. If nil, calls are not stored, but they are
+	// still reported to Observers.
+	Store *Store
+
+	// App is the name of the application whose calls are tracked.
+	App string
+
+	// Host is the host name recorded in tracked calls. If empty, the
+	// system's host name is used.
+	Host string
+
+	// CurrentUser, if set, is called to determine the currently
+	// authenticated user for the current request. The returned user is
+	// stored in the Call record if it's non-nil and has a nonempty ID.
+	CurrentUser func(r *http.Request) *User
+
+	// RouteResolvers are tried, in order, to determine the route of each
+	// call. If empty, the package-level RouteResolvers are used.
+	RouteResolvers []RouteResolver
+
+	// Sampler, if set, determines which requests are tracked. If nil, all
+	// requests are tracked.
+	Sampler Sampler
+
+	// Scrubbers are applied, in order, to each call before it is stored or
+	// reported to Observers.
+	Scrubbers []Scrubber
+
+	// Observers are notified of every call tracked by the Monitor (in
+	// addition to Live).
+	Observers []Observer
+
+	// TrustedProxies are the networks of the reverse proxies and load
+	// balancers in front of the application (see the package-level
+	// TrustedProxies).
+	TrustedProxies []*net.IPNet
+
+	// Live is the Hub that tracked calls are published to. If nil, the
+	// Monitor publishes them to a Hub of its own (see LiveHub).
+	Live *Hub
+
+	// LogCapture, if set, captures the log lines of each call (written with
+	// the loggers returned by Logger and LogHandler) and stores them with
+	// the call if it fails or is slow.
+	LogCapture *LogCapture
+
+	ownLiveOnce sync.Once
+	ownLive     *Hub
+}
+
+// DefaultMonitor returns a Monitor for app configured by the package-level
+// variables DB, DBSchema, CurrentUser, Scrubbers, Observers, TrustedProxies
+// and CaptureLogs (and that publishes calls to LiveCalls). Later changes to
+// the variables don't affect the returned Monitor, but the package-level
+// functions (and Handlers without a Monitor) get a new default Monitor for
+// each call, so changes take effect for calls tracked after them.
+func DefaultMonitor(app string) *Monitor {
+	m := &Monitor{
+		App:            app,
+		CurrentUser:    CurrentUser,
+		Scrubbers:      Scrubbers,
+		Observers:      Observers,
+		TrustedProxies: TrustedProxies,
+		LogCapture:     CaptureLogs,
+		Live:           LiveCalls,
+	}
+	if DB != nil {
+		m.Store = defaultStore()
+	}
+	return m
+}
+
+// StartCall starts tracking c, a call that isn't an HTTP request tracked by
+// BeforeAPICall (e.g., an RPC). It is used to integrate other kinds of servers
+// with appmon. c's App and Host default to m's, and its Start defaults to the
+// current time. c is scrubbed by m.Scrubbers, stored (which sets c.ID) and
+// reported to m.Observers. The caller must call FinishCall when the call is
+// done.
+func (m *Monitor) StartCall(c *Call) {
+	if c.App == "" {
+		c.App = m.App
+	}
+	if c.Host == "" {
+		c.Host = m.host()
+	}
+	if c.Start.IsZero() {
+		c.Start = time.Now().In(time.UTC)
+	}
+	m.scrub(c)
+	if m.LogCapture != nil {
+		c.logs = &logBuffer{max: m.LogCapture.maxLines()}
+	}
+
+	if m.Store != nil {
+		err := m.Store.insertCall(c)
+		if err != nil {
+			log.Printf("insertCall failed: %s", err)
+		}
+	} else {
+		c.ID = newCallID()
+	}
+	m.callStarted(c)
+}
+
+// FinishCall records that c, which was started with StartCall, finished with
+// status s, and reports it to m.Observers. If s.End is unset, it defaults to
+// the current time. If m captures logs and c failed or was slow, c's captured
+// log lines are stored in c.Log. c's Tags and Log are scrubbed by m.Scrubbers
+// (see Scrubber).
+func (m *Monitor) FinishCall(c *Call, s CallStatus) {
+	if !s.End.Valid {
+		s.End = now()
+	}
+	if c.logs != nil && m.LogCapture != nil && m.LogCapture.keep(c, &s) {
+		c.Log = c.logs.Lines()
+	}
+	m.scrubFinished(c)
+	if m.Store != nil {
+		err := m.Store.setCallStatus(c.ID, &s, c.Tags, c.Log)
+		if err != nil {
+			log.Printf("setCallStatus failed for call ID %d: %s", c.ID, err)
+		}
+	}
+	c.CallStatus = s
+	m.callFinished(c)
+}
+
+func (m *Monitor) host() string {
+	if m.Host != "" {
+		return m.Host
+	}
+	return hostname
+}
+
+func (m *Monitor) routeResolvers() []RouteResolver {
+	if len(m.RouteResolvers) > 0 {
+		return m.RouteResolvers
+	}
+	return RouteResolvers
+}
+
+// LiveHub returns the Hub that m publishes tracked calls to: m.Live, or (if
+// m.Live is nil) a Hub of m's own.
+func (m *Monitor) LiveHub() *Hub {
+	if m.Live != nil {
+		return m.Live
+	}
+	m.ownLiveOnce.Do(func() { m.ownLive = &Hub{} })
+	return m.ownLive
+}
+
+func (m *Monitor) scrub(c *Call) {
+	for _, s := range m.Scrubbers {
+		s.Scrub(c)
+	}
+}
+
+// scrubFinished applies m.Scrubbers to the fields of c that are set while it's
+// handled (after it was scrubbed by StartCall). See Scrubber.
+func (m *Monitor) scrubFinished(c *Call) {
+	if len(m.Scrubbers) == 0 || (c.Tags == nil && c.Log == nil) {
+		return
+	}
+	t := &Call{RouteParams: Params{}, QueryParams: Params{}, Tags: c.Tags, Log: c.Log}
+	m.scrub(t)
+	c.Tags, c.Log = t.Tags, t.Log
+}
+
+func (m *Monitor) callStarted(c *Call) {
+	m.LiveHub().CallStarted(c)
+	for _, o := range m.Observers {
+		o.CallStarted(c)
+	}
+}
+
+func (m *Monitor) callFinished(c *Call) {
+	m.LiveHub().CallFinished(c)
+	for _, o := range m.Observers {
+		o.CallFinished(c)
+	}
+}
+
+// A Sampler decides which requests a Monitor tracks.
+type Sampler interface {
+	// Sample returns whether r should be tracked.
+	Sample(r *http.Request) bool
+}
+
+// SamplerFunc is an adapter to allow the use of ordinary functions as
+// Samplers.
+type SamplerFunc func(r *http.Request) bool
+
+// Sample calls f(r).
+func (f SamplerFunc) Sample(r *http.Request) bool { return f(r) }
+
+// RateSampler returns a Sampler that tracks the given fraction (between 0 and
+// 1) of requests, chosen at random. Requests with a parent call ID (see
+// ParentCallIDHeader) are always tracked, so that the calls made on behalf of
+// a tracked call aren't lost.
+func RateSampler(rate float64) Sampler {
+	return SamplerFunc(func(r *http.Request) bool {
+		if _, ok := GetParentCallID(r); ok {
+			return true
+		}
+		return rand.Float64() < rate
+	})
+}
@@ -0,0 +1,123 @@
+package appmon
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// callRecorder is an Observer that records finished calls.
+type callRecorder struct{ calls []*Call }
+
+func (r *callRecorder) CallStarted(c *Call)  {}
+func (r *callRecorder) CallFinished(c *Call) { r.calls = append(r.calls, c) }
+
+func TestMonitor_Independent(t *testing.T) {
+	var obsA, obsB callRecorder
+	a := &Monitor{App: "a", Host: "host-a", Observers: []Observer{&obsA}, Live: &Hub{}}
+	b := &Monitor{
+		App:         "b",
+		Observers:   []Observer{&obsB},
+		Scrubbers:   []Scrubber{ScrubberFunc(func(c *Call) { c.UserAgent = "" })},
+		CurrentUser: func(r *http.Request) *User { return &User{ID: "alice"} },
+		Live:        &Hub{},
+	}
+
+	rt := mux.NewRouter()
+	rt.Path("/a").Handler(a.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	rt.Path("/b").Handler(b.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	for _, path := range []string{"/a", "/b"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", "ua")
+		rt.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(obsA.calls) != 1 || len(obsB.calls) != 1 {
+		t.Fatalf("got %d and %d calls, want 1 each", len(obsA.calls), len(obsB.calls))
+	}
+	ca, cb := obsA.calls[0], obsB.calls[0]
+	if ca.App != "a" || ca.Host != "host-a" || ca.UserAgent != "ua" || ca.User != nil || ca.HTTPStatusCode != http.StatusOK {
+		t.Errorf("bad call for monitor a: %+v", ca)
+	}
+	if cb.App != "b" || cb.Host != hostname || cb.UserAgent != "" || cb.User == nil || cb.HTTPStatusCode != http.StatusTeapot {
+		t.Errorf("bad call for monitor b: %+v", cb)
+	}
+	if ca.ID == 0 || cb.ID == 0 {
+		t.Error("want nonzero IDs")
+	}
+}
+
+func TestMonitor_LiveHub(t *testing.T) {
+	a, b := &Monitor{}, &Monitor{}
+	if a.LiveHub() != a.LiveHub() {
+		t.Error("want a Monitor's own Hub to be reused")
+	}
+	if a.LiveHub() == b.LiveHub() || a.LiveHub() == LiveCalls {
+		t.Error("want Monitors without a Live Hub to have Hubs of their own")
+	}
+	if h := (&Monitor{Live: LiveCalls}).LiveHub(); h != LiveCalls {
+		t.Errorf("got Hub %p, want Live %p", h, LiveCalls)
+	}
+	if h := DefaultMonitor("app").LiveHub(); h != LiveCalls {
+		t.Errorf("got default Monitor's Hub %p, want LiveCalls %p", h, LiveCalls)
+	}
+}
+
+func TestTrackAPICall_DefaultMonitor(t *testing.T) {
+	origDB, origObservers := DB, Observers
+	defer func() { DB, Observers = origDB, origObservers }()
+	DB = nil
+
+	// Changes to the package-level variables take effect for later calls.
+	h := TrackAPICall("app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var obs1, obs2 callRecorder
+	for _, obs := range []*callRecorder{&obs1, &obs2} {
+		Observers = []Observer{obs}
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if len(obs1.calls) != 1 || len(obs2.calls) != 1 {
+		t.Errorf("got %d and %d calls, want 1 each", len(obs1.calls), len(obs2.calls))
+	}
+}
+
+func TestMonitor_Sampler(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{
+		Sampler:   SamplerFunc(func(r *http.Request) bool { return r.URL.Path == "/sampled" }),
+		Observers: []Observer{&obs},
+		Live:      &Hub{},
+	}
+	var tracked []bool
+	h := m.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := GetCallID(r)
+		tracked = append(tracked, ok)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/sampled", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/other", nil))
+
+	if len(tracked) != 2 || !tracked[0] || tracked[1] {
+		t.Errorf("got tracked %v, want [true false]", tracked)
+	}
+	if len(obs.calls) != 1 {
+		t.Errorf("got %d calls, want 1", len(obs.calls))
+	}
+}
+
+func TestRateSampler(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if RateSampler(0).Sample(r) {
+		t.Error("rate 0: want request not sampled")
+	}
+	if !RateSampler(1).Sample(r) {
+		t.Error("rate 1: want request sampled")
+	}
+	r.Header.Set(ParentCallIDHeader, "123")
+	if !RateSampler(0).Sample(r) {
+		t.Error("want request with parent call ID sampled")
+	}
+}
@@ -0,0 +1,19 @@
+package appmon
+
+// An Observer is notified as calls tracked by Handler start and finish. It is
+// called synchronously on the request goroutine, so it must not block; if it
+// needs to keep the Call after returning, it should copy it.
+type Observer interface {
+	// CallStarted is called after c has been recorded, before the wrapped
+	// handler runs.
+	CallStarted(c *Call)
+
+	// CallFinished is called after c's CallStatus has been filled in.
+	CallFinished(c *Call)
+}
+
+// Observers are notified of every call tracked without a Monitor,
+// independently of whether the call was successfully stored in the database.
+// It should be set up before any calls are tracked. (LiveCalls is always
+// notified and need not be added.)
+var Observers []Observer
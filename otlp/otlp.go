@@ -0,0 +1,303 @@
+// Package otlp exports appmon calls as OpenTelemetry spans to an OTLP
+// collector over HTTP/protobuf or gRPC.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+	"github.com/sourcegraph/appmon/internal/export"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultEndpoint is the default OTLP/HTTP traces endpoint of a local
+// collector.
+const DefaultEndpoint = "http://localhost:4318/v1/traces"
+
+const scopeName = "github.com/sourcegraph/appmon"
+
+// Options configures an Exporter.
+type Options struct {
+	// Endpoint is the URL of the collector's OTLP/HTTP traces endpoint. If
+	// empty, DefaultEndpoint is used.
+	Endpoint string
+
+	// Headers are added to each export request (e.g., for authentication).
+	Headers http.Header
+
+	// Client is the HTTP client used to send export requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// Conn, if set, is a connection to the collector's OTLP/gRPC endpoint
+	// (usually port 4317), and spans are sent over gRPC instead of HTTP.
+	// Endpoint and Client are then ignored, and Headers are sent as request
+	// metadata.
+	Conn grpc.ClientConnInterface
+
+	// Store is the Store that the exported calls are stored in. If nil, the
+	// Store of appmon.DefaultMonitor is assumed.
+	Store *appmon.Store
+
+	// Namespace identifies Store, and span and trace IDs are derived from it.
+	// If empty, export.DefaultNamespace(Store) is used (see
+	// github.com/sourcegraph/appmon/internal/export).
+	Namespace string
+
+	// Batching options. Zero values use the defaults in
+	// github.com/sourcegraph/appmon/internal/export.
+	MaxBatch      int
+	MaxQueue      int
+	FlushInterval time.Duration
+	MaxRetries    int
+}
+
+// Exporter is an appmon.Observer that exports each finished call as a span.
+// The call's App is the span's service.name, its Route is the span name, its
+// route and query parameters are span attributes, and its ParentCallID is the
+// parent span. Calls that weren't stored (whose ID is 0) aren't exported.
+type Exporter struct {
+	opt     Options
+	traces  export.Traces
+	batcher *export.Batcher
+}
+
+// NewExporter creates an Exporter and starts its background sender. Callers
+// should add it to appmon.Observers and call Close on shutdown to send any
+// queued spans.
+func NewExporter(opt Options) *Exporter {
+	if opt.Endpoint == "" {
+		opt.Endpoint = DefaultEndpoint
+	}
+	if opt.Client == nil {
+		opt.Client = http.DefaultClient
+	}
+	if opt.Namespace == "" {
+		opt.Namespace = export.DefaultNamespace(opt.Store)
+	}
+	e := &Exporter{opt: opt}
+	e.traces.Namespace = opt.Namespace
+	e.batcher = &export.Batcher{
+		Name:          "OTLP exporter",
+		Send:          e.send,
+		MaxBatch:      opt.MaxBatch,
+		MaxQueue:      opt.MaxQueue,
+		FlushInterval: opt.FlushInterval,
+		MaxRetries:    opt.MaxRetries,
+	}
+	e.batcher.Start()
+	return e
+}
+
+// CallStarted implements appmon.Observer.
+func (e *Exporter) CallStarted(c *appmon.Call) {
+	if c.ID == 0 {
+		return
+	}
+	e.traces.Start(c)
+}
+
+// CallFinished implements appmon.Observer.
+func (e *Exporter) CallFinished(c *appmon.Call) {
+	if c.ID == 0 {
+		return
+	}
+	e.batcher.Add(c)
+}
+
+// Dropped returns the number of spans that were dropped because the queue was
+// full or the collector couldn't be reached.
+func (e *Exporter) Dropped() int64 {
+	return e.batcher.Dropped()
+}
+
+// Close sends all queued spans.
+func (e *Exporter) Close() {
+	e.batcher.Close()
+}
+
+func (e *Exporter) send(calls []*appmon.Call) error {
+	if e.opt.Conn != nil {
+		return e.sendGRPC(calls)
+	}
+
+	body, err := proto.Marshal(e.request(calls))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.opt.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.opt.Headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := e.opt.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP collector returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *Exporter) sendGRPC(calls []*appmon.Call) error {
+	ctx := context.Background()
+	if len(e.opt.Headers) > 0 {
+		md := metadata.MD{}
+		for k, v := range e.opt.Headers {
+			md.Append(k, v...)
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	_, err := collectorpb.NewTraceServiceClient(e.opt.Conn).Export(ctx, e.request(calls))
+	return err
+}
+
+// request builds an export request for calls, with one resource per
+// (app, host).
+func (e *Exporter) request(calls []*appmon.Call) *collectorpb.ExportTraceServiceRequest {
+	type resourceKey struct{ app, host string }
+	var keys []resourceKey
+	spans := make(map[resourceKey][]*tracepb.Span)
+	for _, c := range calls {
+		k := resourceKey{c.App, c.Host}
+		if _, present := spans[k]; !present {
+			keys = append(keys, k)
+		}
+		spans[k] = append(spans[k], e.span(c))
+	}
+
+	req := &collectorpb.ExportTraceServiceRequest{}
+	for _, k := range keys {
+		req.ResourceSpans = append(req.ResourceSpans, &tracepb.ResourceSpans{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{
+					stringAttr("service.name", k.app),
+					stringAttr("host.name", k.host),
+				},
+			},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: scopeName},
+				Spans: spans[k],
+			}},
+		})
+	}
+	return req
+}
+
+func (e *Exporter) span(c *appmon.Call) *tracepb.Span {
+	traceID, spanID := e.traces.TraceID(c), e.traces.SpanID(c.ID)
+	s := &tracepb.Span{
+		TraceId:           traceID[:],
+		SpanId:            spanID[:],
+		Name:              c.Route,
+		Kind:              tracepb.Span_SPAN_KIND_SERVER,
+		StartTimeUnixNano: uint64(c.Start.UnixNano()),
+		EndTimeUnixNano:   uint64(c.End.Time.UnixNano()),
+	}
+	if s.Name == "" {
+		s.Name = c.HTTPMethod
+	}
+	if c.ParentCallID != 0 {
+		parentID := e.traces.SpanID(int64(c.ParentCallID))
+		s.ParentSpanId = parentID[:]
+	}
+
+	s.Attributes = []*commonpb.KeyValue{
+		intAttr("appmon.call_id", c.ID),
+		stringAttr("http.request.method", c.HTTPMethod),
+		stringAttr("url.full", c.URL),
+		intAttr("http.response.status_code", int64(c.HTTPStatusCode)),
+		intAttr("http.response.body.size", int64(c.BodyLength)),
+	}
+	if c.Route != "" {
+		s.Attributes = append(s.Attributes, stringAttr("http.route", c.Route))
+	}
+	if c.RemoteAddr != "" {
+		s.Attributes = append(s.Attributes, stringAttr("client.address", c.RemoteAddr))
+	}
+	if c.UserAgent != "" {
+		s.Attributes = append(s.Attributes, stringAttr("user_agent.original", c.UserAgent))
+	}
+	if c.User != nil {
+		s.Attributes = append(s.Attributes, stringAttr("enduser.id", c.User.ID))
+		if c.User.Tenant != "" {
+			s.Attributes = append(s.Attributes, stringAttr("appmon.tenant", c.User.Tenant))
+		}
+		if len(c.User.Roles) > 0 {
+			s.Attributes = append(s.Attributes, stringAttr("enduser.role", strings.Join(c.User.Roles, ",")))
+		}
+	}
+	s.Attributes = append(s.Attributes, paramAttrs("appmon.route_params.", c.RouteParams)...)
+	s.Attributes = append(s.Attributes, paramAttrs("appmon.query_params.", c.QueryParams)...)
+	s.Attributes = append(s.Attributes, paramAttrs("appmon.tags.", c.Tags)...)
+
+	if c.Err != "" || c.HTTPStatusCode >= 500 {
+		s.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: string(c.Err)}
+	}
+	return s
+}
+
+// paramAttrs returns attributes for params, sorted by name.
+func paramAttrs(prefix string, params appmon.Params) []*commonpb.KeyValue {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := make([]*commonpb.KeyValue, len(names))
+	for i, name := range names {
+		attrs[i] = &commonpb.KeyValue{Key: prefix + name, Value: anyValue(params[name])}
+	}
+	return attrs
+}
+
+func anyValue(v interface{}) *commonpb.AnyValue {
+	switch v := v.(type) {
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case []string:
+		vs := make([]*commonpb.AnyValue, len(v))
+		for i, s := range v {
+			vs[i] = anyValue(s)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: vs}}}
+	case []interface{}:
+		vs := make([]*commonpb.AnyValue, len(v))
+		for i, s := range v {
+			vs[i] = anyValue(s)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: vs}}}
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(v)}}
+}
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intAttr(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
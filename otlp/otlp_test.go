@@ -0,0 +1,207 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+	"github.com/sourcegraph/go-nnz/nnz"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a fake OTLP/HTTP collector that records the spans it receives.
+type collector struct {
+	mu    sync.Mutex
+	reqs  []*collectorpb.ExportTraceServiceRequest
+	fails int // number of requests to fail before accepting
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fails > 0 {
+		c.fails--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		http.Error(w, "bad content type "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	req := &collectorpb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.reqs = append(c.reqs, req)
+}
+
+func TestExporter(t *testing.T) {
+	coll := &collector{fails: 1}
+	srv := httptest.NewServer(coll)
+	defer srv.Close()
+
+	e := NewExporter(Options{Endpoint: srv.URL, FlushInterval: time.Hour})
+	e.batcher.RetryBackoff = time.Millisecond
+
+	start := time.Now()
+	parent := &appmon.Call{ID: 10, App: "web", Host: "h1", Route: "home", HTTPMethod: "GET", Start: start}
+	child := &appmon.Call{
+		ID:           11,
+		ParentCallID: nnz.Int64(10),
+		App:          "api",
+		Host:         "h1",
+		Route:        "get-user",
+		HTTPMethod:   "GET",
+		RouteParams:  appmon.Params{"id": "123"},
+		QueryParams:  appmon.Params{"q": []interface{}{"a", "b"}},
+		Start:        start,
+		CallStatus:   appmon.CallStatus{End: appmon.NullTime{Time: start.Add(time.Millisecond), Valid: true}, HTTPStatusCode: 500, Err: "boom"},
+	}
+	e.CallStarted(parent)
+	e.CallStarted(child)
+	e.CallFinished(child)
+	e.CallFinished(parent)
+	e.Close()
+
+	if len(coll.reqs) != 1 {
+		t.Fatalf("want 1 export request, got %d", len(coll.reqs))
+	}
+	rss := coll.reqs[0].ResourceSpans
+	if len(rss) != 2 {
+		t.Fatalf("want 2 resources, got %d", len(rss))
+	}
+	if name := rss[0].Resource.Attributes[0]; name.Key != "service.name" || name.Value.GetStringValue() != "api" {
+		t.Errorf("want service.name api, got %v", name)
+	}
+
+	childSpan, parentSpan := rss[0].ScopeSpans[0].Spans[0], rss[1].ScopeSpans[0].Spans[0]
+	if childSpan.Name != "get-user" {
+		t.Errorf("want span name get-user, got %q", childSpan.Name)
+	}
+	if !bytes.Equal(childSpan.TraceId, parentSpan.TraceId) {
+		t.Errorf("want child and parent in same trace, got %x and %x", childSpan.TraceId, parentSpan.TraceId)
+	}
+	if !bytes.Equal(childSpan.ParentSpanId, parentSpan.SpanId) {
+		t.Errorf("want child's parent span %x, got %x", parentSpan.SpanId, childSpan.ParentSpanId)
+	}
+	if childSpan.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || childSpan.Status.GetMessage() != "boom" {
+		t.Errorf("want error status, got %v", childSpan.Status)
+	}
+
+	attrs := make(map[string]string)
+	for _, kv := range childSpan.Attributes {
+		attrs[kv.Key] = kv.Value.String()
+	}
+	for _, key := range []string{"appmon.route_params.id", "appmon.query_params.q", "http.response.status_code"} {
+		if _, present := attrs[key]; !present {
+			t.Errorf("missing attribute %q in %v", key, attrs)
+		}
+	}
+}
+
+func TestExporter_DropsAfterRetries(t *testing.T) {
+	coll := &collector{fails: 100}
+	srv := httptest.NewServer(coll)
+	defer srv.Close()
+
+	e := NewExporter(Options{Endpoint: srv.URL, FlushInterval: time.Hour, MaxRetries: 2})
+	e.batcher.RetryBackoff = time.Millisecond
+	c := &appmon.Call{ID: 1, Start: time.Now()}
+	e.CallStarted(c)
+	e.CallFinished(c)
+	e.Close()
+
+	if got := e.Dropped(); got != 1 {
+		t.Errorf("want 1 dropped, got %d", got)
+	}
+	if want, got := 97, coll.fails; want != got {
+		t.Errorf("want %d requests left to fail, got %d", want, got)
+	}
+}
+
+// grpcCollector is a fake OTLP/gRPC collector that records the requests it
+// receives and their metadata.
+type grpcCollector struct {
+	collectorpb.UnimplementedTraceServiceServer
+
+	mu   sync.Mutex
+	reqs []*collectorpb.ExportTraceServiceRequest
+	md   []metadata.MD
+}
+
+func (c *grpcCollector) Export(ctx context.Context, req *collectorpb.ExportTraceServiceRequest) (*collectorpb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	md, _ := metadata.FromIncomingContext(ctx)
+	c.reqs = append(c.reqs, req)
+	c.md = append(c.md, md)
+	return &collectorpb.ExportTraceServiceResponse{}, nil
+}
+
+func TestExporter_GRPC(t *testing.T) {
+	coll := &grpcCollector{}
+	srv := grpc.NewServer()
+	collectorpb.RegisterTraceServiceServer(srv, coll)
+	l := bufconn.Listen(1 << 20)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	e := NewExporter(Options{Conn: conn, Headers: http.Header{"Authorization": {"Bearer t"}}, FlushInterval: time.Hour})
+	c := &appmon.Call{ID: 1, App: "web", Route: "home", Start: time.Now()}
+	e.CallStarted(c)
+	e.CallFinished(c)
+	e.Close()
+
+	if len(coll.reqs) != 1 {
+		t.Fatalf("want 1 export request, got %d", len(coll.reqs))
+	}
+	if name := coll.reqs[0].ResourceSpans[0].ScopeSpans[0].Spans[0].Name; name != "home" {
+		t.Errorf("want span name home, got %q", name)
+	}
+	if auth := coll.md[0].Get("authorization"); len(auth) != 1 || auth[0] != "Bearer t" {
+		t.Errorf("want authorization metadata, got %v", coll.md[0])
+	}
+	if got := e.Dropped(); got != 0 {
+		t.Errorf("want 0 dropped, got %d", got)
+	}
+}
+
+func TestNewExporter_StoreNamespace(t *testing.T) {
+	ids := func(opt Options) []byte {
+		opt.FlushInterval = time.Hour
+		e := NewExporter(opt)
+		defer e.Close()
+		id := e.traces.SpanID(1)
+		return id[:]
+	}
+	if bytes.Equal(ids(Options{}), ids(Options{Store: &appmon.Store{Schema: "other"}})) {
+		t.Error("want Stores with different schemas to have different span IDs")
+	}
+	if !bytes.Equal(ids(Options{}), ids(Options{Store: &appmon.Store{Schema: appmon.DBSchema}})) {
+		t.Error("want the default Store to have the same span IDs as a nil Store")
+	}
+}
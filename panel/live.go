@@ -0,0 +1,172 @@
+package panel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+)
+
+// liveBuffer is the number of events queued for each live tail client before
+// events are dropped.
+const liveBuffer = 100
+
+// liveHeartbeat is how often a comment is sent to idle live tail clients, to
+// keep proxies from closing the connection.
+const liveHeartbeat = 15 * time.Second
+
+// liveCalls streams call events matching the "app", "route", "status", "uid"
+// and "tenant" querystring parameters as Server-Sent Events.
+func (p *Panel) liveCalls(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	f := appmon.CallFilter{
+		App:    q.Get("app"),
+		Route:  q.Get("route"),
+		Status: q.Get("status"),
+		UID:    q.Get("uid"),
+		Tenant: q.Get("tenant"),
+	}
+
+	s := p.live().Subscribe(f, liveBuffer)
+	defer p.live().Unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-s.C:
+			data, err := json.Marshal(e.Call)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (p *Panel) uiLive(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tmpl(appmonUILive, uiLiveHTML)(w, struct {
+		common
+		App    string
+		Route  string
+		Status string
+		UID    string
+		Tenant string
+	}{
+		common: p.newCommon("Live"),
+		App:    q.Get("app"),
+		Route:  q.Get("route"),
+		Status: q.Get("status"),
+		UID:    q.Get("uid"),
+		Tenant: q.Get("tenant"),
+	})
+}
+
+var uiLiveHTML = `
+<h1>Live calls</h1>
+<div class="row-fluid">
+  <div class="col-md-2">
+    <form action="live" method="get" class="form">
+      <div class="form-group">
+        <label for="app">App</label>
+        <input type="text" class="form-control" id="app" name="app" value="{{.App}}">
+      </div>
+      <div class="form-group">
+        <label for="route">Route</label>
+        <input type="text" class="form-control" id="route" name="route" value="{{.Route}}">
+      </div>
+      <div class="form-group">
+        <label for="status">Status</label>
+        <input type="text" class="form-control" id="status" name="status" placeholder="e.g., 404 or 5xx" value="{{.Status}}">
+      </div>
+      <div class="form-group">
+        <label for="uid">User</label>
+        <input type="text" class="form-control" id="uid" name="uid" value="{{.UID}}">
+      </div>
+      <div class="form-group">
+        <label for="tenant">Tenant</label>
+        <input type="text" class="form-control" id="tenant" name="tenant" value="{{.Tenant}}">
+      </div>
+      <button type="submit" class="btn btn-primary">Filter</button>
+    </form>
+    <p class="text-muted" id="live-status">Connecting...</p>
+  </div>
+  <div class="col-md-10">
+    <table class="table">
+      <thead><tr><th>ID</th><th>App</th><th>Route</th><th>URL</th><th>User</th><th>Duration</th><th>Status</th></tr></thead>
+      <tbody id="live-calls"></tbody>
+    </table>
+  </div>
+</div>
+<script>
+(function() {
+  var maxRows = 200;
+  var tbody = document.getElementById("live-calls");
+  var status = document.getElementById("live-status");
+  var source = new EventSource("live/events" + location.search);
+  source.onopen = function() { status.textContent = "Connected."; };
+  source.onerror = function() { status.textContent = "Disconnected; retrying..."; };
+
+  function cell(tr, text) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    tr.appendChild(td);
+    return td;
+  }
+
+  function render(tr, c, finished) {
+    tr.innerHTML = "";
+    var id = cell(tr, "");
+    var a = document.createElement("a");
+    a.href = "calls/" + c.ID;
+    a.textContent = c.ID;
+    id.appendChild(a);
+    cell(tr, c.App);
+    cell(tr, c.Route || "(unnamed)");
+    cell(tr, c.URL).style.wordBreak = "break-all";
+    cell(tr, c.User ? (c.User.Name || c.User.ID) + (c.User.Tenant ? " (" + c.User.Tenant + ")" : "") : "Anon");
+    cell(tr, finished ? (new Date(c.End) - new Date(c.Start)) + "ms" : "...");
+    cell(tr, finished ? c.HTTPStatusCode : "").title = c.Err || "";
+    tr.className = finished && (c.HTTPStatusCode < 200 || c.HTTPStatusCode >= 400) ? "danger" : (finished ? "" : "active");
+  }
+
+  function handle(finished) {
+    return function(e) {
+      var c = JSON.parse(e.data);
+      var tr = document.getElementById("live-call-" + c.ID);
+      if (!tr) {
+        tr = document.createElement("tr");
+        tr.id = "live-call-" + c.ID;
+        tbody.insertBefore(tr, tbody.firstChild);
+        while (tbody.childNodes.length > maxRows) {
+          tbody.removeChild(tbody.lastChild);
+        }
+      }
+      render(tr, c, finished);
+    };
+  }
+  source.addEventListener("start", handle(false));
+  source.addEventListener("finish", handle(true));
+})();
+</script>
+`
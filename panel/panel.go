@@ -2,32 +2,386 @@ package panel
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/sourcegraph/appmon"
 	"log"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	appmonQueryCalls = "appmon:queryCalls"
+	appmonLiveCalls  = "appmon:liveCalls"
+	appmonMigrations = "appmon:migrations"
+	appmonAudit      = "appmon:privacyAudit"
 )
 
-// Router adds panel routes to an existing mux.Router.
+// NextCursorHeader is the HTTP response header of the /calls endpoint that
+// contains the value of the "cursor" parameter that returns the next page of
+// calls. It is absent on the last page.
+const NextCursorHeader = "X-Appmon-Next-Cursor"
+
+const (
+	defaultCallsLimit = 100
+	maxCallsLimit     = 1000
+)
+
+// planCheckInterval is how long the result of checking the panel's query plans
+// is cached.
+const planCheckInterval = 10 * time.Minute
+
+// A Panel serves the JSON API and web UI for the calls tracked by a Monitor.
+type Panel struct {
+	// Monitor's Store is queried for calls, its LiveHub provides live
+	// calls, and its CurrentUser identifies who performs privacy
+	// operations. If nil, the default Monitor (configured by appmon's
+	// package-level variables) is used.
+	Monitor *appmon.Monitor
+
+	// BaseHref is the URL path prefix of the web UI routes (e.g.,
+	// "/appmon/"), used for links in UI pages.
+	BaseHref string
+
+	// planCheck caches the result of CheckQueryPlans, which runs several
+	// EXPLAIN queries.
+	planCheck struct {
+		sync.Mutex
+		checked  time.Time
+		warnings []*appmon.PlanWarning
+	}
+}
+
+func (p *Panel) monitor() *appmon.Monitor {
+	if p.Monitor != nil {
+		return p.Monitor
+	}
+	return appmon.DefaultMonitor("")
+}
+
+func (p *Panel) store() *appmon.Store {
+	if s := p.monitor().Store; s != nil {
+		return s
+	}
+	return &appmon.Store{DB: appmon.DB, Schema: appmon.DBSchema}
+}
+
+func (p *Panel) live() *appmon.Hub {
+	return p.monitor().LiveHub()
+}
+
+// Router adds panel routes for the default Monitor to an existing mux.Router.
 func Router(rt *mux.Router) *mux.Router {
-	rt.Path("/calls").Methods("GET").HandlerFunc(queryCalls).Name(appmonQueryCalls)
+	return (&Panel{}).Router(rt)
+}
+
+// Router adds panel routes to an existing mux.Router.
+func (p *Panel) Router(rt *mux.Router) *mux.Router {
+	rt.Path("/calls/live").Methods("GET").HandlerFunc(p.liveCalls).Name(appmonLiveCalls)
+	rt.Path("/calls").Methods("GET").HandlerFunc(p.queryCalls).Name(appmonQueryCalls)
+	rt.Path("/migrations").Methods("GET").HandlerFunc(p.migrations).Name(appmonMigrations)
+	rt.Path("/privacy/audit").Methods("GET").HandlerFunc(p.privacyAudit).Name(appmonAudit)
 	return rt
 }
 
-func queryCalls(w http.ResponseWriter, r *http.Request) {
-	calls, err := appmon.QueryCalls("")
+// migrations returns the database schema version and pending migrations as
+// JSON.
+func (p *Panel) migrations(w http.ResponseWriter, r *http.Request) {
+	status, err := p.getSchemaStatus()
+	if err != nil {
+		log.Printf("getSchemaStatus: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// privacyAudit returns the privacy audit records for the user given by the
+// "uid" querystring parameter (or for all users, if empty) as JSON.
+func (p *Panel) privacyAudit(w http.ResponseWriter, r *http.Request) {
+	records, err := p.store().QueryPrivacyAuditRecords(r.URL.Query().Get("uid"))
+	if err != nil {
+		log.Printf("QueryPrivacyAuditRecords: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []*appmon.PrivacyAuditRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// checkQueryPlans returns the result of the store's CheckQueryPlans, which is
+// cached for planCheckInterval.
+func (p *Panel) checkQueryPlans() ([]*appmon.PlanWarning, error) {
+	p.planCheck.Lock()
+	defer p.planCheck.Unlock()
+	if time.Since(p.planCheck.checked) < planCheckInterval {
+		return p.planCheck.warnings, nil
+	}
+	warnings, err := p.store().CheckQueryPlans()
+	if err != nil {
+		return nil, err
+	}
+	p.planCheck.checked, p.planCheck.warnings = time.Now(), warnings
+	return warnings, nil
+}
+
+type schemaStatus struct {
+	Version int
+	Pending []appmon.Migration
+}
+
+func (p *Panel) getSchemaStatus() (*schemaStatus, error) {
+	version, err := p.store().SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := p.store().PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		pending = []appmon.Migration{}
+	}
+	return &schemaStatus{Version: version, Pending: pending}, nil
+}
+
+// queryCalls returns calls matching the querystring parameters as a JSON
+// array. If there are more matching calls, the NextCursorHeader response
+// header is set. The parameters are:
+//
+//	app, route, host, uid, tenant exact match
+//	status_min, status_max        HTTP status code range (inclusive)
+//	since, until                  start time range (RFC 3339)
+//	min_duration                  minimum duration (e.g., "250ms")
+//	parent                        parent call ID
+//	trace                         call ID; matches the call and its descendants
+//	url                           URL substring
+//	route_param.NAME              route parameter NAME has this value
+//	query_param.NAME              querystring parameter NAME has this value
+//	tag.NAME                      tag NAME has this value
+//	sort                          "start" (default), "duration" or "id"
+//	order                         "desc" (default) or "asc"
+//	limit                         maximum number of calls (default 100)
+//	cursor                        NextCursorHeader of the previous page
+//	fields                        comma-separated Call fields to return
+func (p *Panel) queryCalls(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cq := &appmon.CallQuery{
+		App:         q.Get("app"),
+		Route:       q.Get("route"),
+		Host:        q.Get("host"),
+		UID:         q.Get("uid"),
+		Tenant:      q.Get("tenant"),
+		URLContains: q.Get("url"),
+		Sort:        q.Get("sort"),
+		Cursor:      q.Get("cursor"),
+		Limit:       defaultCallsLimit,
+	}
+
+	intParams := []struct {
+		param string
+		v     *int64
+	}{
+		{"parent", &cq.ParentCallID},
+		{"trace", &cq.TraceCallID},
+	}
+	for _, p := range intParams {
+		if s := q.Get(p.param); s != "" {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("bad '%s' parameter: %s", p.param, err), http.StatusBadRequest)
+				return
+			}
+			*p.v = v
+		}
+	}
+
+	smallIntParams := []struct {
+		param string
+		v     *int
+	}{
+		{"status_min", &cq.StatusMin},
+		{"status_max", &cq.StatusMax},
+	}
+	for _, p := range smallIntParams {
+		if s := q.Get(p.param); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("bad '%s' parameter: %s", p.param, err), http.StatusBadRequest)
+				return
+			}
+			*p.v = v
+		}
+	}
+
+	timeParams := []struct {
+		param string
+		v     *time.Time
+	}{
+		{"since", &cq.Since},
+		{"until", &cq.Until},
+	}
+	for _, p := range timeParams {
+		if s := q.Get(p.param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("bad '%s' parameter: %s", p.param, err), http.StatusBadRequest)
+				return
+			}
+			*p.v = t
+		}
+	}
+
+	if s := q.Get("min_duration"); s != "" {
+		var err error
+		cq.MinDuration, err = time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, "bad 'min_duration' parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for k, vs := range q {
+		if name := strings.TrimPrefix(k, "route_param."); name != k {
+			if cq.RouteParams == nil {
+				cq.RouteParams = make(map[string]string)
+			}
+			cq.RouteParams[name] = vs[0]
+		} else if name := strings.TrimPrefix(k, "query_param."); name != k {
+			if cq.QueryParams == nil {
+				cq.QueryParams = make(map[string]string)
+			}
+			cq.QueryParams[name] = vs[0]
+		} else if name := strings.TrimPrefix(k, "tag."); name != k {
+			if cq.Tags == nil {
+				cq.Tags = make(map[string]string)
+			}
+			cq.Tags[name] = vs[0]
+		}
+	}
+
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		cq.Ascending = true
+	default:
+		http.Error(w, "bad 'order' parameter", http.StatusBadRequest)
+		return
+	}
+
+	if s := q.Get("limit"); s != "" {
+		var err error
+		cq.Limit, err = strconv.Atoi(s)
+		if err != nil || cq.Limit <= 0 || cq.Limit > maxCallsLimit {
+			http.Error(w, fmt.Sprintf("bad 'limit' parameter (must be 1-%d)", maxCallsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := cq.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var fields []string
+	if s := q.Get("fields"); s != "" {
+		fields = strings.Split(s, ",")
+		for _, f := range fields {
+			if !callFields[f] {
+				http.Error(w, fmt.Sprintf("bad 'fields' parameter: unknown field %q", f), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	// Fetch one more call than requested to determine whether there's a next
+	// page.
+	limit := cq.Limit
+	cq.Limit++
+	calls, err := p.store().QueryCalls(cq)
 	if err != nil {
 		log.Printf("QueryCalls: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if calls == nil {
-		calls = []*appmon.Call{}
+	if len(calls) > limit {
+		calls = calls[:limit]
+		w.Header().Set(NextCursorHeader, cq.CallCursor(calls[limit-1]))
+	}
+	resp := []interface{}{}
+	for _, c := range calls {
+		if fields == nil {
+			resp = append(resp, c)
+			continue
+		}
+		v, err := selectFields(c, fields)
+		if err != nil {
+			log.Printf("selectFields: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp = append(resp, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// callFields is the set of JSON field names of a Call.
+var callFields = jsonFields(reflect.TypeOf(appmon.Call{}))
+
+// jsonFields returns the set of JSON field names of the struct type t,
+// including the fields of embedded structs (which encoding/json promotes).
+// Fields that are omitted when empty are included.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+			continue
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			for name := range jsonFields(f.Type) {
+				fields[name] = true
+			}
+			continue
+		case !f.IsExported():
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = true
+	}
+	return fields
+}
+
+// selectFields returns the JSON representation of c with only the given
+// fields. If fields is nil, all fields are returned.
+func selectFields(c *appmon.Call, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return all, nil
+	}
+	m := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		m[f] = all[f]
 	}
-	json.NewEncoder(w).Encode(calls)
+	return m, nil
 }
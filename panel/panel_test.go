@@ -0,0 +1,34 @@
+package panel
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/sourcegraph/appmon"
+)
+
+func TestCallFields(t *testing.T) {
+	for _, f := range []string{"ID", "ParentCallID", "Route", "End", "HTTPStatusCode", "Tags", "Log"} {
+		if !callFields[f] {
+			t.Errorf("want %q in call fields", f)
+		}
+	}
+	for _, f := range []string{"CallStatus", "logs"} {
+		if callFields[f] {
+			t.Errorf("want %q not in call fields", f)
+		}
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	c := &appmon.Call{ID: 1, Route: "r"}
+	got, err := selectFields(c, []string{"ID", "Log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]json.RawMessage{"ID": json.RawMessage("1"), "Log": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -1,11 +1,11 @@
 package panel
 
 import (
-	"database/sql"
 	"fmt"
 	"html/template"
 	"math"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
@@ -16,29 +16,42 @@ import (
 )
 
 const (
-	appmonUIRoutes = "appmon:ui:routes"
-	appmonUICall   = "appmon:ui:call"
-	appmonUICalls  = "appmon:ui:calls"
-	appmonUIMain   = "appmon:ui:main"
+	appmonUIRoutes      = "appmon:ui:routes"
+	appmonUICall        = "appmon:ui:call"
+	appmonUICalls       = "appmon:ui:calls"
+	appmonUILive        = "appmon:ui:live"
+	appmonUILiveEvents  = "appmon:ui:liveEvents"
+	appmonUIMain        = "appmon:ui:main"
+	appmonUIUser        = "appmon:ui:user"
+	appmonUIUserExport  = "appmon:ui:userExport"
+	appmonUIUserPrivacy = "appmon:ui:userPrivacy"
 )
 
-var baseHref string
+// UIRouter adds web UI routes for the default Monitor, at the URL path prefix
+// baseHref, to an existing mux.Router.
+func UIRouter(baseHref string, rt *mux.Router) *mux.Router {
+	return (&Panel{BaseHref: baseHref}).UIRouter(rt)
+}
 
-// Router adds panel routes to an existing mux.Router.
-func UIRouter(theBaseHref string, rt *mux.Router) *mux.Router {
-	baseHref = theBaseHref
-	rt.Path(`/calls/{CallID:\d+}`).Methods("GET").HandlerFunc(uiCall).Name(appmonUICall)
-	rt.Path("/calls").Methods("GET").HandlerFunc(uiCalls).Name(appmonUICalls)
-	rt.Path("/").Methods("GET").HandlerFunc(uiMain).Name(appmonUIMain)
+// UIRouter adds web UI routes to an existing mux.Router.
+func (p *Panel) UIRouter(rt *mux.Router) *mux.Router {
+	rt.Path(`/calls/{CallID:\d+}`).Methods("GET").HandlerFunc(p.uiCall).Name(appmonUICall)
+	rt.Path("/calls").Methods("GET").HandlerFunc(p.uiCalls).Name(appmonUICalls)
+	rt.Path("/live/events").Methods("GET").HandlerFunc(p.liveCalls).Name(appmonUILiveEvents)
+	rt.Path("/live").Methods("GET").HandlerFunc(p.uiLive).Name(appmonUILive)
+	rt.Path("/user/export").Methods("POST").HandlerFunc(p.uiUserExport).Name(appmonUIUserExport)
+	rt.Path("/user/privacy").Methods("POST").HandlerFunc(p.uiUserPrivacy).Name(appmonUIUserPrivacy)
+	rt.Path("/user").Methods("GET").HandlerFunc(p.uiUser).Name(appmonUIUser)
+	rt.Path("/").Methods("GET").HandlerFunc(p.uiMain).Name(appmonUIMain)
 
 	return rt
 }
 
-func uiCall(w http.ResponseWriter, r *http.Request) {
+func (p *Panel) uiCall(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	callID, _ := strconv.ParseInt(v["CallID"], 10, 64)
 
-	calls, err := appmon.QueryCalls(`WHERE id=$1 OR parent_call_id=$1 ORDER BY start ASC`, callID)
+	calls, err := p.store().QueryCalls(&appmon.CallQuery{TraceCallID: callID, Sort: appmon.SortByStart, Ascending: true})
 	if err != nil {
 		http.Error(w, "QueryCalls failed: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -49,7 +62,7 @@ func uiCall(w http.ResponseWriter, r *http.Request) {
 		CallID int64
 		Calls  []*appmon.Call
 	}{
-		common: newCommon("Call"),
+		common: p.newCommon("Call"),
 		CallID: callID,
 		Calls:  calls,
 	})
@@ -69,13 +82,23 @@ var uiCallHTML = `
         {{range .Calls}}
           {{$isParent:=(eq .ID $CallID)}}
           <tr class="{{if isHTTPError .HTTPStatusCode}}danger{{end}} {{if $isParent}}parent-call{{end}}">
-            <td>{{.ID}} {{if $isParent}}<br><strong class="text-muted">Parent</strong>{{end}}</td>
+            <td>{{.ID}} {{if $isParent}}<br><strong class="text-muted">Parent</strong>{{else if ne .ParentCallID $CallID}}<br><small class="text-muted">child of {{.ParentCallID}}</small>{{end}}</td>
             <td style="max-width:150px"><strong>{{.Route}}</strong></td>
             <td>{{.Duration}}</td>
-            <td style="word-wrap:break-word;max-width:200px;"><tt style="font-size:0.85em"><a href="{{.URL}}" target="_blank">{{.URL}}</a></tt></td>
+            {{if .IsJob}}
+              <td style="word-wrap:break-word;max-width:200px;"><span class="label label-default">job</span> <tt style="font-size:0.85em">{{range $k, $v := .RouteParams}}{{$k}}={{$v}} {{end}}</tt></td>
+            {{else}}
+              <td style="word-wrap:break-word;max-width:200px;"><tt style="font-size:0.85em"><a href="{{.URL}}" target="_blank">{{.URL}}</a></tt></td>
+            {{end}}
             <td>{{bytes .BodyLength}}</td>
             <td title="{{.Err}}">{{.HTTPStatusCode}}</td>
           </tr>
+          {{if .Log}}
+            <tr class="call-log">
+              <td colspan="6"><pre style="max-height:300px;overflow:auto;font-size:0.85em">{{range .Log}}{{.}}
+{{end}}</pre></td>
+            </tr>
+          {{end}}
         {{else}}
           <tr><td colspan="5" class="alert alert-warning">No calls found for call ID {{.CallID}}.</td></tr>
         {{end}}
@@ -85,7 +108,7 @@ var uiCallHTML = `
 </div>
 `
 
-func uiCalls(w http.ResponseWriter, r *http.Request) {
+func (p *Panel) uiCalls(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 
 	lastNHoursStr := q.Get("lastNHours")
@@ -116,23 +139,128 @@ func uiCalls(w http.ResponseWriter, r *http.Request) {
 	if sort == "" {
 		sort = "date"
 	}
-	sorts := map[string]string{"date": "start", "duration": `"end" - "start"`}
+	sorts := map[string]string{"date": appmon.SortByStart, "duration": appmon.SortByDuration}
 	if _, ok := sorts[sort]; !ok {
 		http.Error(w, "bad 'sort' parameter", http.StatusBadRequest)
 		return
 	}
 
-	callRoutes, err := getCallRoutes(lastNHours, failedOnly)
+	groupBy := q.Get("groupBy")
+	if groupBy == "" {
+		groupBy = "route"
+	}
+	switch groupBy {
+	case "route", appmon.GroupByUser, appmon.GroupByTenant, "tag":
+	default:
+		http.Error(w, "bad 'groupBy' parameter", http.StatusBadRequest)
+		return
+	}
+	groupTag := q.Get("groupTag")
+	if groupBy == "tag" && groupTag == "" {
+		http.Error(w, "missing 'groupTag' parameter (required to group by tag)", http.StatusBadRequest)
+		return
+	}
+
+	routeParams, err := parseParamFilter(q.Get("routeParams"))
+	if err != nil {
+		http.Error(w, "bad 'routeParams' parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	queryParams, err := parseParamFilter(q.Get("queryParams"))
 	if err != nil {
-		http.Error(w, "getCallRoutes failed: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "bad 'queryParams' parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	tags, err := parseParamFilter(q.Get("tags"))
+	if err != nil {
+		http.Error(w, "bad 'tags' parameter: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var calls []*appmon.Call
+	filters := &appmon.CallQuery{
+		UID:         q.Get("uid"),
+		Tenant:      q.Get("tenant"),
+		Since:       time.Now().Add(-time.Duration(lastNHours) * time.Hour),
+		Failed:      failedOnly,
+		RouteParams: routeParams,
+		QueryParams: queryParams,
+		Tags:        tags,
+	}
+
+	// filterQuery is the querystring of the current filters, less the
+	// parameters that the links in the group list set.
+	filterQuery := url.Values{}
+	for _, k := range []string{"lastNHours", "failedOnly", "sort", "groupBy", "groupTag", "routeParams", "queryParams", "tags", "uid", "tenant"} {
+		if v := q.Get(k); v != "" {
+			filterQuery.Set(k, v)
+		}
+	}
+
+	var callRoutes []*callRoute
+	var userStats []*appmon.UserStats
+	var tagStats []*appmon.TagStats
 	selectedRoute := q.Get("route")
+	selectedTagValue := q.Get("tagValue")
 	selectedApp := q.Get("app")
-	if selectedRoute != "" && selectedApp != "" {
-		calls, err = appmon.QueryCalls(`WHERE app = $1 AND route = $2 AND (current_timestamp - "start" < ($3::int * interval '1 hour')) AND ((NOT $4) OR (http_status_code < 200 OR http_status_code >= 400)) ORDER BY `+sorts[sort]+` DESC LIMIT 100`, selectedApp, selectedRoute, lastNHours, failedOnly)
+	var selected bool
+	switch groupBy {
+	case "route":
+		callRoutes, err = p.getCallRoutes(filters)
+		if err != nil {
+			http.Error(w, "getCallRoutes failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		selected = selectedRoute != "" && selectedApp != ""
+	case appmon.GroupByUser, appmon.GroupByTenant:
+		// Group stats aren't filtered by the selected user or tenant.
+		groupFilters := *filters
+		if groupBy == appmon.GroupByUser {
+			groupFilters.UID = ""
+			filterQuery.Del("uid")
+			selected = filters.UID != ""
+		} else {
+			groupFilters.Tenant = ""
+			filterQuery.Del("tenant")
+			selected = filters.Tenant != ""
+		}
+		userStats, err = p.store().QueryUserStats(&groupFilters, groupBy)
+		if err != nil {
+			http.Error(w, "QueryUserStats failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "tag":
+		// Group stats aren't filtered by the tag being grouped by.
+		groupFilters := *filters
+		groupFilters.Tags = make(map[string]string, len(filters.Tags))
+		for k, v := range filters.Tags {
+			if k != groupTag {
+				groupFilters.Tags[k] = v
+			}
+		}
+		tagStats, err = p.store().QueryTagStats(&groupFilters, groupTag)
+		if err != nil {
+			http.Error(w, "QueryTagStats failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		selected = selectedTagValue != ""
+	}
+
+	var calls []*appmon.Call
+	if selected {
+		cq := *filters
+		switch groupBy {
+		case "route":
+			cq.App, cq.Route = selectedApp, selectedRoute
+		case "tag":
+			cq.Tags = make(map[string]string, len(filters.Tags)+1)
+			for k, v := range filters.Tags {
+				cq.Tags[k] = v
+			}
+			cq.Tags[groupTag] = selectedTagValue
+		}
+		cq.Sort = sorts[sort]
+		cq.Limit = 100
+		calls, err = p.store().QueryCalls(&cq)
 		if err != nil {
 			http.Error(w, "QueryCalls failed: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -144,18 +272,42 @@ func uiCalls(w http.ResponseWriter, r *http.Request) {
 		LastNHours    int
 		FailedOnly    bool
 		Sort          string
+		GroupBy       string
+		GroupTag      string
+		RouteParams   string
+		QueryParams   string
+		Tags          string
+		UID           string
+		Tenant        string
+		FilterQuery   template.URL
 		CallRoutes    []*callRoute
+		UserStats     []*appmon.UserStats
+		TagStats      []*appmon.TagStats
 		SelectedApp   string
 		SelectedRoute string
+		SelectedTag   string
+		Selected      bool
 		Calls         []*appmon.Call
 	}{
-		common:        newCommon("Calls"),
+		common:        p.newCommon("Calls"),
 		LastNHours:    lastNHours,
 		FailedOnly:    failedOnly,
 		Sort:          sort,
+		GroupBy:       groupBy,
+		GroupTag:      groupTag,
+		RouteParams:   q.Get("routeParams"),
+		QueryParams:   q.Get("queryParams"),
+		Tags:          q.Get("tags"),
+		UID:           filters.UID,
+		Tenant:        filters.Tenant,
+		FilterQuery:   template.URL(filterQuery.Encode()),
 		CallRoutes:    callRoutes,
+		UserStats:     userStats,
+		TagStats:      tagStats,
 		SelectedApp:   selectedApp,
 		SelectedRoute: selectedRoute,
+		SelectedTag:   selectedTagValue,
+		Selected:      selected,
 		Calls:         calls,
 	})
 }
@@ -167,29 +319,33 @@ type callRoute struct {
 	AvgDuration int64
 }
 
-func getCallRoutes(lastNHours int, failedOnly bool) (callRoutes []*callRoute, err error) {
-	var rows *sql.Rows
-	callRouteSQL := `
-      SELECT * FROM (
-        SELECT c.app, c.route, COUNT(c.*) AS count, ROUND(AVG(extract(epoch from (c."end" - c.start))*1000000))::bigint AS avg_duration
-        FROM "` + appmon.DBSchema + `".call c
-        WHERE current_timestamp - c.start < ($1::int * interval '1 hour')
-          AND c."end" IS NOT NULL
-          AND ((NOT $2) OR (http_status_code < 200 OR http_status_code >= 400))
-        GROUP BY app, route
-      ) q ORDER BY count DESC
-`
-	rows, err = appmon.DB.Query(callRouteSQL, lastNHours, failedOnly)
+// parseParamFilter parses a param filter entered in querystring format (e.g.,
+// "id=123&q=foo").
+func parseParamFilter(s string) (map[string]string, error) {
+	vals, err := url.ParseQuery(s)
+	if err != nil || len(vals) == 0 {
+		return nil, err
+	}
+	m := make(map[string]string, len(vals))
+	for k := range vals {
+		m[k] = vals.Get(k)
+	}
+	return m, nil
+}
+
+// getCallRoutes returns the routes of the calls matching filters.
+func (p *Panel) getCallRoutes(filters *appmon.CallQuery) (callRoutes []*callRoute, err error) {
+	stats, err := p.store().QueryRouteStats(filters)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		cr := new(callRoute)
-		err = rows.Scan(&cr.App, &cr.Route, &cr.Count, &cr.AvgDuration)
-		if err != nil {
-			return
-		}
-		callRoutes = append(callRoutes, cr)
+	for _, rs := range stats {
+		callRoutes = append(callRoutes, &callRoute{
+			App:         rs.App,
+			Route:       rs.Route,
+			Count:       rs.Count,
+			AvgDuration: int64(rs.AvgDuration / time.Microsecond),
+		})
 	}
 	return
 }
@@ -201,6 +357,22 @@ var uiCallsHTML = `
     <form action="calls" method="get" class="form">
       {{if .SelectedRoute}}<input type="hidden" name="route" value="{{.SelectedRoute}}">{{end}}
       {{if .SelectedApp}}<input type="hidden" name="app" value="{{.SelectedApp}}">{{end}}
+      <div class="form-group">
+        <label>Group by:</label>
+        <div class="radio">
+          <label><input type="radio" name="groupBy" value="route" {{if eq .GroupBy "route"}}checked{{end}}> Route</label>
+        </div>
+        <div class="radio">
+          <label><input type="radio" name="groupBy" value="user" {{if eq .GroupBy "user"}}checked{{end}}> User</label>
+        </div>
+        <div class="radio">
+          <label><input type="radio" name="groupBy" value="tenant" {{if eq .GroupBy "tenant"}}checked{{end}}> Tenant</label>
+        </div>
+        <div class="radio">
+          <label><input type="radio" name="groupBy" value="tag" {{if eq .GroupBy "tag"}}checked{{end}}> Tag</label>
+          <input type="text" class="form-control input-sm" name="groupTag" placeholder="tag name" value="{{.GroupTag}}">
+        </div>
+      </div>
       <div class="form-group">
         <label for="lastNHours">Last # hours</label>
         <input type="number" class="form-control" id="lastNHours" name="lastNHours" placeholder="#" value="{{.LastNHours}}">
@@ -211,6 +383,26 @@ var uiCallsHTML = `
           <label><input type="checkbox" name="failedOnly" value="t" {{if .FailedOnly }}checked{{end}}> Failures</label>
         </div>
       </div>
+      <div class="form-group">
+        <label for="uid">User</label>
+        <input type="text" class="form-control" id="uid" name="uid" value="{{.UID}}">
+      </div>
+      <div class="form-group">
+        <label for="tenant">Tenant</label>
+        <input type="text" class="form-control" id="tenant" name="tenant" value="{{.Tenant}}">
+      </div>
+      <div class="form-group">
+        <label for="routeParams">Route params</label>
+        <input type="text" class="form-control" id="routeParams" name="routeParams" placeholder="id=123" value="{{.RouteParams}}">
+      </div>
+      <div class="form-group">
+        <label for="queryParams">Query params</label>
+        <input type="text" class="form-control" id="queryParams" name="queryParams" placeholder="q=foo&amp;page=2" value="{{.QueryParams}}">
+      </div>
+      <div class="form-group">
+        <label for="tags">Tags</label>
+        <input type="text" class="form-control" id="tags" name="tags" placeholder="plan=pro" value="{{.Tags}}">
+      </div>
       <div class="form-group">
         <label>Sort order:</label>
         <div class="radio">
@@ -225,13 +417,15 @@ var uiCallsHTML = `
   </div>
   <div class="col-md-3">
     <div class="list-group">
-    {{$LastNHours := .LastNHours}}
-    {{$FailedOnly := .FailedOnly}}
-    {{$Sort := .Sort}}
+    {{$FilterQuery := .FilterQuery}}
     {{$SelectedRoute := .SelectedRoute}}
     {{$SelectedApp := .SelectedApp}}
+    {{$UID := .UID}}
+    {{$Tenant := .Tenant}}
+    {{$SelectedTag := .SelectedTag}}
+    {{if eq .GroupBy "route"}}
     {{range .CallRoutes}}
-      <a href="calls?sort={{$Sort}}&failedOnly={{$FailedOnly}}&lastNHours={{$LastNHours}}&route={{.Route}}&app={{.App}}" class="list-group-item {{if and (eq $SelectedRoute .Route) (eq $SelectedApp .App)}}active{{end}}">
+      <a href="calls?{{$FilterQuery}}&route={{.Route}}&app={{.App}}" class="list-group-item {{if and (eq $SelectedRoute .Route) (eq $SelectedApp .App)}}active{{end}}">
         <strong>{{if .App}}{{.App}}{{else}}(no app){{end}}</strong>
         {{if .Route}}{{.Route}}{{else}}(unnamed){{end}}
         <span class="badge">{{.Count|num}}</span>
@@ -240,11 +434,43 @@ var uiCallsHTML = `
     {{else}}
       <li><div class="alert alert-error">No routes to show.</div></li>
     {{end}}
+    {{else if eq .GroupBy "user"}}
+    {{range .UserStats}}
+      <a href="calls?{{$FilterQuery}}&uid={{.UID}}" class="list-group-item {{if eq $UID .UID}}active{{end}}">
+        <strong>{{if .Name}}{{.Name}}{{else}}{{.UID}}{{end}}</strong>
+        {{if .Tenant}}<span class="text-muted">{{.Tenant}}</span>{{end}}
+        <span class="badge">{{.Count|num}}</span>
+        {{if .Failed}}<span class="badge alert-danger">{{.Failed|num}} failed</span>{{end}}
+      </a>
+    {{else}}
+      <li><div class="alert alert-error">No users to show.</div></li>
+    {{end}}
+    {{else if eq .GroupBy "tag"}}
+    {{range .TagStats}}
+      <a href="calls?{{$FilterQuery}}&tagValue={{.Value}}" class="list-group-item {{if eq $SelectedTag .Value}}active{{end}}">
+        <strong>{{.Value}}</strong>
+        <span class="badge">{{.Count|num}}</span>
+        {{if .Failed}}<span class="badge alert-danger">{{.Failed|num}} failed</span>{{end}}
+      </a>
+    {{else}}
+      <li><div class="alert alert-error">No tag values to show.</div></li>
+    {{end}}
+    {{else}}
+    {{range .UserStats}}
+      <a href="calls?{{$FilterQuery}}&tenant={{.Tenant}}" class="list-group-item {{if eq $Tenant .Tenant}}active{{end}}">
+        <strong>{{.Tenant}}</strong>
+        <span class="badge">{{.Count|num}}</span>
+        {{if .Failed}}<span class="badge alert-danger">{{.Failed|num}} failed</span>{{end}}
+      </a>
+    {{else}}
+      <li><div class="alert alert-error">No tenants to show.</div></li>
+    {{end}}
+    {{end}}
     </div>
   </div>
   <div class="col-md-7">
-     {{if eq .SelectedRoute ""}}
-       <div class="alert alert-warning">Select a route.</div>
+     {{if not .Selected}}
+       <div class="alert alert-warning">Select a {{.GroupBy}}.</div>
      {{else}}
        <table class="table">
          <thead><tr><th>ID</th><th>Start</th><th>URL</th><th>User</th><th>Duration</th><th>Bytes</th><th>Status</th></thead>
@@ -256,14 +482,14 @@ var uiCallsHTML = `
                  {{.Start.Format "2006-01-02 15:04:05"}}<br>
                  <span class="text-muted">{{timeAgo .Start}}</span>
                </td>
-               <td style="word-wrap:break-word;max-width:200px;"><a href="{{.URL}}" target="_blank">{{.URL}}</a></td>
-               <td title="{{.RemoteAddr}} -- {{.UserAgent}}">{{if .UID}}{{.UID}}{{else}}Anon{{end}}</td>
+               <td style="word-wrap:break-word;max-width:200px;">{{if .IsJob}}<span class="label label-default">job</span>{{else}}<a href="{{.URL}}" target="_blank">{{.URL}}</a>{{end}}{{range $k, $v := .Tags}} <span class="label label-info">{{$k}}={{$v}}</span>{{end}}</td>
+               <td title="{{.RemoteAddr}} -- {{.UserAgent}}">{{with .User}}<a href="user?uid={{.ID}}">{{if .Name}}{{.Name}}{{else}}{{.ID}}{{end}}</a>{{if .Tenant}}<br><span class="text-muted">{{.Tenant}}</span>{{end}}{{else}}Anon{{end}}</td>
                <td>{{.Duration}}</td>
                <td>{{bytes .BodyLength}}</td>
                <td title="{{.Err}}">{{.HTTPStatusCode}}</td>
              </tr>
            {{else}}
-             <tr><td colspan="5" class="alert alert-warning">No calls found for route {{$SelectedRoute}}.</td></tr>
+             <tr><td colspan="5" class="alert alert-warning">No calls found.</td></tr>
            {{end}}
          </tbody>
        </table>
@@ -272,12 +498,50 @@ var uiCallsHTML = `
 </div>
 `
 
-func uiMain(w http.ResponseWriter, r *http.Request) {
-	tmpl(appmonUIMain, uiMainHTML)(w, newCommon("Main"))
+func (p *Panel) uiMain(w http.ResponseWriter, r *http.Request) {
+	status, err := p.getSchemaStatus()
+	if err != nil {
+		http.Error(w, "getSchemaStatus failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	planWarnings, err := p.checkQueryPlans()
+	if err != nil {
+		http.Error(w, "CheckQueryPlans failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl(appmonUIMain, uiMainHTML)(w, struct {
+		common
+		Schema       *schemaStatus
+		PlanWarnings []*appmon.PlanWarning
+	}{
+		common:       p.newCommon("Main"),
+		Schema:       status,
+		PlanWarnings: planWarnings,
+	})
 }
 
 var uiMainHTML = `
-
+<h1>Appmon</h1>
+{{with .Schema}}
+  {{if .Pending}}
+    <div class="alert alert-warning">
+      <p>The database schema (version {{.Version}}) has {{len .Pending}} pending migration(s). Call <tt>appmon.MigrateDB</tt> to apply them:</p>
+      <ul>
+        {{range .Pending}}<li>{{.Version}}: {{.Name}}</li>{{end}}
+      </ul>
+    </div>
+  {{else}}
+    <p class="text-muted">The database schema is up to date (version {{.Version}}).</p>
+  {{end}}
+{{end}}
+{{range .PlanWarnings}}
+  <div class="alert alert-warning">
+    <p>The "{{.Query}}" query uses a sequential scan of the call table, which is slow for large tables. Check that all migrations have been applied.</p>
+    <pre>{{.Plan}}</pre>
+  </div>
+{{end}}
 `
 
 type common struct {
@@ -285,8 +549,8 @@ type common struct {
 	BaseHref string
 }
 
-func newCommon(title string) common {
-	return common{title, baseHref}
+func (p *Panel) newCommon(title string) common {
+	return common{title, p.BaseHref}
 }
 
 func tmpl(name, bodySource string) func(http.ResponseWriter, interface{}) {
@@ -326,6 +590,7 @@ func tmpl(name, bodySource string) func(http.ResponseWriter, interface{}) {
       <div class="navbar-collapse collapse">
         <ul class="nav navbar-nav">
           <li><a href="calls">Calls</a></li>
+          <li><a href="live">Live</a></li>
         </ul>
       </div><!--/.nav-collapse -->
     </div>
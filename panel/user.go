@@ -0,0 +1,362 @@
+package panel
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+)
+
+const (
+	// defaultSessionGap is the default minimum time between a user's calls
+	// that starts a new session.
+	defaultSessionGap = 30 * time.Minute
+
+	// maxUserCalls is the maximum number of a user's calls shown on the user
+	// page.
+	maxUserCalls = 1000
+
+	// numSlowestRoutes is the number of slowest routes shown on the user page.
+	numSlowestRoutes = 5
+)
+
+// A session is a series of calls by a user with no gaps longer than the
+// session gap between them.
+type session struct {
+	Start, End time.Time
+	Calls      []*appmon.Call // ordered by start time, most recent first
+	Failed     int
+}
+
+func (s *session) Duration() time.Duration { return s.End.Sub(s.Start) }
+
+// groupSessions groups calls, which must be ordered by start time (oldest
+// first), into sessions. A new session starts when a call starts more than gap
+// after the previous call ended. The most recent session is returned first.
+func groupSessions(calls []*appmon.Call, gap time.Duration) []*session {
+	var sessions []*session
+	var cur *session
+	for _, c := range calls {
+		if cur == nil || c.Start.Sub(cur.End) > gap {
+			cur = &session{Start: c.Start, End: c.Start}
+			sessions = append(sessions, cur)
+		}
+		end := c.Start
+		if c.End.Valid {
+			end = c.End.Time
+		}
+		if end.After(cur.End) {
+			cur.End = end
+		}
+		cur.Calls = append(cur.Calls, c)
+		if c.End.Valid && isFailed(c.HTTPStatusCode) {
+			cur.Failed++
+		}
+	}
+	for _, s := range sessions {
+		slices.Reverse(s.Calls)
+	}
+	slices.Reverse(sessions)
+	return sessions
+}
+
+func isFailed(code int) bool { return code < 200 || code >= 400 }
+
+// uiUser shows the activity of the user given by the "uid" querystring
+// parameter: their calls grouped into sessions, error rate and slowest
+// routes.
+func (p *Panel) uiUser(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	uid := q.Get("uid")
+	if uid == "" {
+		http.Error(w, "missing 'uid' parameter", http.StatusBadRequest)
+		return
+	}
+
+	lastNHours := 24
+	if s := q.Get("lastNHours"); s != "" {
+		var err error
+		lastNHours, err = strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "bad 'lastNHours' parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	gap := defaultSessionGap
+	if s := q.Get("gap"); s != "" {
+		var err error
+		gap, err = time.ParseDuration(s)
+		if err != nil || gap <= 0 {
+			http.Error(w, "bad 'gap' parameter (must be a positive duration, e.g., \"30m\")", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filters := appmon.CallQuery{UID: uid, Since: time.Now().Add(-time.Duration(lastNHours) * time.Hour)}
+
+	// Fetch the most recent calls, then put them in chronological order for
+	// groupSessions.
+	cq := filters
+	cq.Limit = maxUserCalls
+	calls, err := p.store().QueryCalls(&cq)
+	if err != nil {
+		http.Error(w, "QueryCalls failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, j := 0, len(calls)-1; i < j; i, j = i+1, j-1 {
+		calls[i], calls[j] = calls[j], calls[i]
+	}
+
+	var user *appmon.User
+	if len(calls) > 0 {
+		user = calls[len(calls)-1].User
+	}
+
+	var finished, failed int
+	for _, c := range calls {
+		if c.End.Valid {
+			finished++
+			if isFailed(c.HTTPStatusCode) {
+				failed++
+			}
+		}
+	}
+	var errorRate float64
+	if finished > 0 {
+		errorRate = 100 * float64(failed) / float64(finished)
+	}
+
+	slowest, err := p.getCallRoutes(&filters)
+	if err != nil {
+		http.Error(w, "getCallRoutes failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.SliceStable(slowest, func(i, j int) bool { return slowest[i].AvgDuration > slowest[j].AvgDuration })
+	if len(slowest) > numSlowestRoutes {
+		slowest = slowest[:numSlowestRoutes]
+	}
+
+	audit, err := p.store().QueryPrivacyAuditRecords(uid)
+	if err != nil {
+		http.Error(w, "QueryPrivacyAuditRecords failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl(appmonUIUser, uiUserHTML)(w, struct {
+		common
+		UID           string
+		User          *appmon.User
+		LastNHours    int
+		Gap           time.Duration
+		Sessions      []*session
+		NumCalls      int
+		Truncated     bool
+		Failed        int
+		ErrorRate     float64
+		SlowestRoutes []*callRoute
+		Audit         []*appmon.PrivacyAuditRecord
+	}{
+		common:        p.newCommon("User " + uid),
+		UID:           uid,
+		User:          user,
+		LastNHours:    lastNHours,
+		Gap:           gap,
+		Sessions:      groupSessions(calls, gap),
+		NumCalls:      len(calls),
+		Truncated:     len(calls) == maxUserCalls,
+		Failed:        failed,
+		ErrorRate:     errorRate,
+		SlowestRoutes: slowest,
+		Audit:         audit,
+	})
+}
+
+// privacyActor returns the actor recorded in the privacy audit log for
+// privacy operations requested by r.
+func (p *Panel) privacyActor(r *http.Request) string {
+	if p.monitor().CurrentUser != nil {
+		if u := p.monitor().CurrentUser(r); u != nil && u.ID != "" {
+			return u.ID
+		}
+	}
+	return "panel (" + r.RemoteAddr + ")"
+}
+
+// sameOrigin reports whether r, a form POST, was sent by a page from the same
+// origin as the panel, according to its Sec-Fetch-Site, Origin or Referer
+// header. Requests with none of them (e.g., from command-line clients) are
+// allowed. This protects privacy operations from cross-site request forgery.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+		// Not sent by older browsers and non-browser clients.
+	default:
+		return false
+	}
+	for _, h := range []string{"Origin", "Referer"} {
+		if v := r.Header.Get(h); v != "" {
+			u, err := url.Parse(v)
+			return err == nil && u.Host == r.Host
+		}
+	}
+	return true
+}
+
+// uiUserExport downloads all stored calls by the user given by the "uid"
+// form value as JSON. The export is buffered, so that an error doesn't leave
+// a partial download.
+func (p *Panel) uiUserExport(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	uid := r.PostFormValue("uid")
+	if uid == "" {
+		http.Error(w, "missing 'uid' parameter", http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := p.store().ExportUserCalls(&buf, uid, p.privacyActor(r)); err != nil {
+		log.Printf("ExportUserCalls: %s", err)
+		http.Error(w, "ExportUserCalls failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="appmon-user-calls.json"`)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("writing user calls export: %s", err)
+	}
+}
+
+// uiUserPrivacy deletes or anonymizes (depending on the "operation" form
+// value) all stored calls by the user given by the "uid" form value.
+func (p *Panel) uiUserPrivacy(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	uid, op := r.PostFormValue("uid"), r.PostFormValue("operation")
+	if uid == "" {
+		http.Error(w, "missing 'uid' parameter", http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch op {
+	case appmon.PrivacyDelete:
+		_, err = p.store().DeleteUserCalls(uid, p.privacyActor(r))
+	case appmon.PrivacyAnonymize:
+		_, err = p.store().AnonymizeUserCalls(uid, p.privacyActor(r))
+	default:
+		http.Error(w, "bad 'operation' parameter", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, op+" failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, p.BaseHref+"user?uid="+url.QueryEscape(uid), http.StatusSeeOther)
+}
+
+var uiUserHTML = `
+<h1>User {{with .User}}{{if .Name}}{{.Name}} <small>{{.ID}}</small>{{else}}{{.ID}}{{end}}{{else}}{{.UID}}{{end}}</h1>
+{{with .User}}
+  <p class="text-muted">
+    {{if .Tenant}}Tenant: <a href="calls?groupBy=tenant&tenant={{.Tenant}}">{{.Tenant}}</a>{{end}}
+    {{if .Roles}}&middot; Roles: {{range $i, $r := .Roles}}{{if $i}}, {{end}}{{$r}}{{end}}{{end}}
+  </p>
+{{end}}
+<div class="row-fluid">
+  <div class="col-md-3">
+    <form action="user" method="get" class="form">
+      <input type="hidden" name="uid" value="{{.UID}}">
+      <div class="form-group">
+        <label for="lastNHours">Last # hours</label>
+        <input type="number" class="form-control" id="lastNHours" name="lastNHours" value="{{.LastNHours}}">
+      </div>
+      <div class="form-group">
+        <label for="gap">Session gap</label>
+        <input type="text" class="form-control" id="gap" name="gap" placeholder="e.g., 30m" value="{{.Gap}}">
+      </div>
+      <button type="submit" class="btn btn-primary">Update</button>
+    </form>
+    <h3>Summary</h3>
+    <dl>
+      <dt>Calls</dt><dd>{{.NumCalls|num}}{{if .Truncated}}+ <span class="text-muted">(only the most recent are shown)</span>{{end}}</dd>
+      <dt>Sessions</dt><dd>{{len .Sessions}}</dd>
+      <dt>Error rate</dt><dd class="{{if .Failed}}text-danger{{end}}">{{printf "%.1f" .ErrorRate}}% ({{.Failed|num}} failed)</dd>
+    </dl>
+    <h3>Slowest routes</h3>
+    <div class="list-group">
+      {{range .SlowestRoutes}}
+        <a href="calls?uid={{$.UID}}&route={{.Route}}&app={{.App}}&sort=duration" class="list-group-item">
+          <strong>{{if .App}}{{.App}}{{else}}(no app){{end}}</strong>
+          {{if .Route}}{{.Route}}{{else}}(unnamed){{end}}
+          <span class="badge">{{.Count|num}}</span>
+          <span class="badge {{durationBadgeClass .AvgDuration}}"><span class="glyphicon glyphicon-time" style="font-size:0.85em"></span> {{duration .AvgDuration}}</span>
+        </a>
+      {{else}}
+        <li><div class="alert alert-warning">No finished calls.</div></li>
+      {{end}}
+    </div>
+    <h3>Privacy</h3>
+    <form action="user/export" method="post">
+      <input type="hidden" name="uid" value="{{.UID}}">
+      <p><button type="submit" class="btn btn-default btn-sm">Export calls as JSON</button></p>
+    </form>
+    <form action="user/privacy" method="post" onsubmit="return confirm('Remove this user\'s identity from all of their stored calls? This can\'t be undone.');">
+      <input type="hidden" name="uid" value="{{.UID}}">
+      <input type="hidden" name="operation" value="anonymize">
+      <p><button type="submit" class="btn btn-warning btn-sm">Anonymize calls</button></p>
+    </form>
+    <form action="user/privacy" method="post" onsubmit="return confirm('Delete all of this user\'s stored calls? This can\'t be undone.');">
+      <input type="hidden" name="uid" value="{{.UID}}">
+      <input type="hidden" name="operation" value="delete">
+      <p><button type="submit" class="btn btn-danger btn-sm">Delete calls</button></p>
+    </form>
+    {{if .Audit}}
+      <table class="table table-condensed">
+        <thead><tr><th>Time</th><th>Operation</th><th>Calls</th><th>Actor</th></tr></thead>
+        <tbody>
+          {{range .Audit}}
+            <tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Operation}}</td><td>{{.Calls}}</td><td>{{.Actor}}</td></tr>
+          {{end}}
+        </tbody>
+      </table>
+    {{end}}
+  </div>
+  <div class="col-md-9">
+    {{range .Sessions}}
+      <h4>
+        {{.Start.Format "2006-01-02 15:04:05"}} <span class="text-muted">({{timeAgo .Start}} ago)</span>
+        <small>{{len .Calls}} calls over {{.Duration}}{{if .Failed}}, <span class="text-danger">{{.Failed}} failed</span>{{end}}</small>
+      </h4>
+      <table class="table table-condensed">
+        <thead><tr><th>ID</th><th>Start</th><th>App</th><th>Route</th><th>URL</th><th>Duration</th><th>Status</th></tr></thead>
+        <tbody>
+          {{range .Calls}}
+            <tr class="{{if isHTTPError .HTTPStatusCode}}danger{{end}}">
+              <td><a href="calls/{{.ID}}">{{.ID}}</a></td>
+              <td>{{.Start.Format "15:04:05"}}</td>
+              <td>{{.App}}</td>
+              <td>{{if .Route}}{{.Route}}{{else}}(unnamed){{end}}</td>
+              <td style="word-wrap:break-word;max-width:250px;"><tt style="font-size:0.85em">{{.URL}}</tt></td>
+              <td>{{.Duration}}</td>
+              <td title="{{.Err}}">{{.HTTPStatusCode}}</td>
+            </tr>
+          {{end}}
+        </tbody>
+      </table>
+    {{else}}
+      <div class="alert alert-warning">No calls by this user in the last {{.LastNHours}} hours.</div>
+    {{end}}
+  </div>
+</div>
+`
@@ -0,0 +1,89 @@
+package panel
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+)
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		header, value string
+		want          bool
+	}{
+		{"", "", true},
+		{"Sec-Fetch-Site", "same-origin", true},
+		{"Sec-Fetch-Site", "cross-site", false},
+		{"Sec-Fetch-Site", "same-site", false},
+		{"Origin", "http://example.com", true},
+		{"Origin", "http://evil.example.com", false},
+		{"Origin", "null", false},
+		{"Referer", "http://example.com/appmon/user?uid=1", true},
+		{"Referer", "http://evil.example.com/", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "http://example.com/appmon/user/privacy", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if got := sameOrigin(r); got != test.want {
+			t.Errorf("%s: %q: got %v, want %v", test.header, test.value, got, test.want)
+		}
+	}
+}
+
+func TestGroupSessions(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	const gap = 30 * time.Minute
+	// call returns a call with the given ID that starts start after t0 and
+	// lasts d (or hasn't finished, if d is negative).
+	call := func(id int64, start, d time.Duration) *appmon.Call {
+		c := &appmon.Call{ID: id, Start: t0.Add(start)}
+		c.HTTPStatusCode = 200
+		if d >= 0 {
+			c.End = appmon.NullTime{Time: c.Start.Add(d), Valid: true}
+		}
+		return c
+	}
+
+	tests := map[string]struct {
+		calls []*appmon.Call
+		want  [][]int64 // call IDs of each session, most recent first
+	}{
+		"none":   {},
+		"one":    {calls: []*appmon.Call{call(1, 0, 0)}, want: [][]int64{{1}}},
+		"at gap": {calls: []*appmon.Call{call(1, 0, 0), call(2, gap, 0), call(3, 2*gap, 0)}, want: [][]int64{{3, 2, 1}}},
+		"after gap": {
+			calls: []*appmon.Call{call(1, 0, 0), call(2, gap+time.Second, 0), call(3, gap+2*time.Second, 0)},
+			want:  [][]int64{{3, 2}, {1}},
+		},
+		"gap measured from end": {
+			calls: []*appmon.Call{call(1, 0, time.Hour), call(2, time.Hour+gap, 0)},
+			want:  [][]int64{{2, 1}},
+		},
+		"gap measured from latest end": {
+			calls: []*appmon.Call{call(1, 0, time.Hour), call(2, time.Minute, 0), call(3, time.Hour+gap, 0)},
+			want:  [][]int64{{3, 2, 1}},
+		},
+		"unfinished": {
+			calls: []*appmon.Call{call(1, 0, -1), call(2, gap+time.Second, -1)},
+			want:  [][]int64{{2}, {1}},
+		},
+	}
+	for label, test := range tests {
+		var got [][]int64
+		for _, s := range groupSessions(test.calls, gap) {
+			var ids []int64
+			for _, c := range s.Calls {
+				ids = append(ids, c.ID)
+			}
+			got = append(got, ids)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got sessions %v, want %v", label, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package appmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// PlanCheckMinRows is the estimated number of rows in the call table below
+// which CheckQueryPlans doesn't check query plans. Sequential scans of small
+// tables are fast (and often chosen by the planner over indexes).
+var PlanCheckMinRows int64 = 100000
+
+// A PlanWarning describes a panel query that the database would run with a
+// sequential scan of the call table.
+type PlanWarning struct {
+	// Query describes the panel query.
+	Query string
+
+	// Plan is the EXPLAIN output for the query, in JSON format.
+	Plan string
+}
+
+func (w *PlanWarning) String() string {
+	return fmt.Sprintf("panel query %q uses a sequential scan of the call table; check that all migrations have been applied", w.Query)
+}
+
+// planCheckQuery is a representative panel query whose plan is checked.
+type planCheckQuery struct {
+	name string
+	sql  func() (string, []interface{}, error)
+}
+
+// planCheckQueries returns the panel's most common queries.
+func (s *Store) planCheckQueries() []planCheckQuery {
+	since := time.Now().Add(-time.Hour)
+	calls := func(q *CallQuery) func() (string, []interface{}, error) {
+		return func() (string, []interface{}, error) { return s.callQuerySQL(q) }
+	}
+	return []planCheckQuery{
+		{"calls to route", calls(&CallQuery{App: "app", Route: "route", Since: since, Limit: 100})},
+		{"call and descendants", calls(&CallQuery{TraceCallID: 1, Ascending: true})},
+		{"failed calls", calls(&CallQuery{Failed: true, Since: since, Limit: 100})},
+		{"route stats", func() (string, []interface{}, error) { return s.routeStatsSQL(&CallQuery{Since: since}) }},
+	}
+}
+
+// CheckQueryPlans checks whether the panel's common queries would fall back to
+// sequential scans of the call table, which is slow for large tables. It logs
+// and returns a warning for each such query. If the call table has fewer than
+// PlanCheckMinRows rows (as estimated by the database), no warnings are
+// returned.
+func (s *Store) CheckQueryPlans() (warnings []*PlanWarning, err error) {
+	var rows int64
+	err = s.DB.QueryRow(`SELECT COALESCE(MAX(reltuples), 0)::bigint FROM pg_class WHERE oid = to_regclass($1)`, `"`+s.Schema+`".call`).Scan(&rows)
+	if err != nil || rows < PlanCheckMinRows {
+		return nil, err
+	}
+
+	for _, q := range s.planCheckQueries() {
+		query, args, err := q.sql()
+		if err != nil {
+			return nil, err
+		}
+		var plan string
+		err = s.DB.QueryRow(`EXPLAIN (FORMAT JSON) `+query, args...).Scan(&plan)
+		if err != nil {
+			return nil, fmt.Errorf("EXPLAIN of %s query failed: %s", q.name, err)
+		}
+		seqScan, err := planHasSeqScan(plan, "call")
+		if err != nil {
+			return nil, err
+		}
+		if seqScan {
+			w := &PlanWarning{Query: q.name, Plan: plan}
+			log.Printf("warning: %s", w)
+			warnings = append(warnings, w)
+		}
+	}
+	return
+}
+
+// planNode is a node of a PostgreSQL JSON-format query plan.
+type planNode struct {
+	NodeType     string      `json:"Node Type"`
+	RelationName string      `json:"Relation Name"`
+	Plans        []*planNode `json:"Plans"`
+}
+
+// planHasSeqScan returns whether the JSON-format EXPLAIN output plan contains
+// a sequential scan of the named table.
+func planHasSeqScan(plan, table string) (bool, error) {
+	var explain []struct {
+		Plan *planNode `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(plan), &explain); err != nil {
+		return false, err
+	}
+	var walk func(*planNode) bool
+	walk = func(n *planNode) bool {
+		if n == nil {
+			return false
+		}
+		if n.NodeType == "Seq Scan" && n.RelationName == table {
+			return true
+		}
+		for _, child := range n.Plans {
+			if walk(child) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, e := range explain {
+		if walk(e.Plan) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,43 @@
+package appmon
+
+import (
+	"testing"
+)
+
+func TestPlanHasSeqScan(t *testing.T) {
+	tests := []struct {
+		plan string
+		want bool
+	}{
+		{`[{"Plan": {"Node Type": "Index Scan", "Relation Name": "call"}}]`, false},
+		{`[{"Plan": {"Node Type": "Seq Scan", "Relation Name": "call"}}]`, true},
+		{`[{"Plan": {"Node Type": "Seq Scan", "Relation Name": "other"}}]`, false},
+		{`[{"Plan": {"Node Type": "Limit", "Plans": [{"Node Type": "Sort", "Plans": [{"Node Type": "Seq Scan", "Relation Name": "call"}]}]}}]`, true},
+		{`[{"Plan": {"Node Type": "BitmapOr", "Plans": [{"Node Type": "Bitmap Index Scan"}, {"Node Type": "Bitmap Index Scan"}]}}]`, false},
+	}
+	for _, test := range tests {
+		got, err := planHasSeqScan(test.plan, "call")
+		if err != nil {
+			t.Errorf("%s: %s", test.plan, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: want %v, got %v", test.plan, test.want, got)
+		}
+	}
+}
+
+func TestCheckQueryPlans(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	orig := PlanCheckMinRows
+	defer func() { PlanCheckMinRows = orig }()
+	PlanCheckMinRows = 0
+
+	// The test table is tiny, so the planner may choose sequential scans;
+	// just check that all of the queries can be explained.
+	if _, err := CheckQueryPlans(); err != nil {
+		t.Fatal(err)
+	}
+}
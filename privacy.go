@@ -0,0 +1,153 @@
+package appmon
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// Privacy operations on a user's stored calls, recorded in PrivacyAuditRecords.
+const (
+	PrivacyExport    = "export"
+	PrivacyDelete    = "delete"
+	PrivacyAnonymize = "anonymize"
+)
+
+// A PrivacyAuditRecord records an export, deletion or anonymization of a
+// user's stored calls.
+type PrivacyAuditRecord struct {
+	ID        int64
+	Operation string // PrivacyExport, PrivacyDelete or PrivacyAnonymize
+	UID       string // the user whose calls were operated on
+	Actor     string // who requested the operation (e.g., an admin's user ID)
+	Calls     int64  // number of calls exported, deleted or anonymized
+	Time      time.Time
+}
+
+var errNoUID = errors.New("no UID given")
+
+// ExportUserCalls writes all stored calls made by the user with the given ID
+// to w, as a JSON array ordered by start time, and records the export in the
+// privacy audit log. Actor identifies who requested the export. It returns the
+// number of calls exported. The export is recorded even if it fails, with the
+// number of calls written to w before the failure.
+func (s *Store) ExportUserCalls(w io.Writer, uid, actor string) (n int64, err error) {
+	if uid == "" {
+		return 0, errNoUID
+	}
+	defer func() {
+		auditErr := s.insertPrivacyAuditRecord(s.DB, PrivacyExport, uid, actor, n)
+		if err == nil {
+			err = auditErr
+		}
+	}()
+	if _, err = io.WriteString(w, "["); err != nil {
+		return
+	}
+	q := &CallQuery{UID: uid, Sort: SortByID, Ascending: true}
+	for {
+		calls, err := s.QueryCalls(q)
+		if err != nil {
+			return n, err
+		}
+		if len(calls) == 0 {
+			break
+		}
+		for _, c := range calls {
+			if n > 0 {
+				if _, err := io.WriteString(w, ",\n"); err != nil {
+					return n, err
+				}
+			}
+			data, err := json.Marshal(c)
+			if err != nil {
+				return n, err
+			}
+			if _, err := w.Write(data); err != nil {
+				return n, err
+			}
+			n++
+		}
+		q.Cursor = q.CallCursor(calls[len(calls)-1])
+	}
+	_, err = io.WriteString(w, "]\n")
+	return
+}
+
+// DeleteUserCalls deletes all stored calls made by the user with the given ID
+// and records the deletion in the privacy audit log. Actor identifies who
+// requested the deletion. It returns the number of calls deleted.
+func (s *Store) DeleteUserCalls(uid, actor string) (n int64, err error) {
+	return s.modifyUserCalls(PrivacyDelete, uid, actor, `DELETE FROM "`+s.Schema+`".call WHERE uid = $1`)
+}
+
+// AnonymizeUserCalls removes the user's identity from all stored calls made by
+// the user with the given ID: their user ID, name, roles, tags (which may
+// identify the user) and captured log lines are removed, and their remote
+// address and user agent are masked. The calls themselves (and their tenant)
+// are kept, so aggregate statistics other than tag statistics are unaffected.
+// Identifiers in call URLs and params are not changed (use Scrubbers to keep
+// them out of stored calls). The anonymization is recorded in the privacy
+// audit log. Actor identifies who requested it. It returns the number of calls
+// anonymized.
+func (s *Store) AnonymizeUserCalls(uid, actor string) (n int64, err error) {
+	return s.modifyUserCalls(PrivacyAnonymize, uid, actor, `
+UPDATE "`+s.Schema+`".call
+SET uid = NULL, user_name = NULL, user_roles = NULL, remote_addr = NULL, remote_addr_chain = NULL, user_agent = '', tags = NULL, log = NULL
+WHERE uid = $1`)
+}
+
+// modifyUserCalls runs the SQL statement stmt, which modifies the calls by
+// the user given by its $1 argument, and records the operation in the privacy
+// audit log, in a single transaction.
+func (s *Store) modifyUserCalls(op, uid, actor, stmt string) (n int64, err error) {
+	if uid == "" {
+		return 0, errNoUID
+	}
+	err = s.inTx(func(dbh DBH) error {
+		res, err := dbh.Exec(stmt, uid)
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		return s.insertPrivacyAuditRecord(dbh, op, uid, actor, n)
+	})
+	return
+}
+
+func (s *Store) insertPrivacyAuditRecord(dbh DBH, op, uid, actor string, calls int64) error {
+	_, err := dbh.Exec(`
+INSERT INTO "`+s.Schema+`".privacy_audit(operation, uid, actor, calls, "time")
+VALUES($1, $2, $3, $4, $5)
+`, op, uid, actor, calls, time.Now().In(time.UTC))
+	return err
+}
+
+// QueryPrivacyAuditRecords returns the privacy audit records for the user with
+// the given ID, or for all users if uid is empty, most recent first.
+func (s *Store) QueryPrivacyAuditRecords(uid string) (records []*PrivacyAuditRecord, err error) {
+	var rows *sql.Rows
+	rows, err = s.DB.Query(`
+SELECT id, operation, uid, actor, calls, "time" FROM "`+s.Schema+`".privacy_audit
+WHERE $1 = '' OR uid = $1
+ORDER BY id DESC
+`, uid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := new(PrivacyAuditRecord)
+		err = rows.Scan(&r.ID, &r.Operation, &r.UID, &r.Actor, &r.Calls, &r.Time)
+		if err != nil {
+			return
+		}
+		records = append(records, r)
+	}
+	err = rows.Err()
+	return
+}
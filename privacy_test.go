@@ -0,0 +1,100 @@
+package appmon
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func insertUserCalls(t *testing.T, uids ...string) {
+	for _, uid := range uids {
+		c := makeCall()
+		c.User = &User{ID: uid, Name: uid, Tenant: "acme"}
+		c.RemoteAddr = "1.2.3.4"
+		c.UserAgent = "ua"
+		if err := defaultStore().insertCall(c); err != nil {
+			t.Fatal("insertCall", err)
+		}
+	}
+}
+
+func TestExportUserCalls(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	insertUserCalls(t, "alice", "bob", "alice")
+
+	var buf bytes.Buffer
+	n, err := ExportUserCalls(&buf, "alice", "admin")
+	if err != nil {
+		t.Fatal("ExportUserCalls", err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 calls exported, got %d", n)
+	}
+	var calls []*Call
+	if err := json.Unmarshal(buf.Bytes(), &calls); err != nil {
+		t.Fatalf("exported JSON: %s\n%s", err, buf.Bytes())
+	}
+	if len(calls) != 2 || calls[0].User.ID != "alice" || calls[0].ID >= calls[1].ID {
+		t.Errorf("got exported calls %+v", calls)
+	}
+
+	records, err := QueryPrivacyAuditRecords("alice")
+	if err != nil {
+		t.Fatal("QueryPrivacyAuditRecords", err)
+	}
+	if len(records) != 1 || records[0].Operation != PrivacyExport || records[0].Actor != "admin" || records[0].Calls != 2 {
+		t.Errorf("got audit records %+v", records)
+	}
+}
+
+func TestDeleteUserCalls(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	insertUserCalls(t, "alice", "bob", "alice")
+
+	n, err := DeleteUserCalls("alice", "admin")
+	if err != nil {
+		t.Fatal("DeleteUserCalls", err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 calls deleted, got %d", n)
+	}
+	c := getOnlyOneCall(t)
+	if c.User.ID != "bob" {
+		t.Errorf("want only bob's call left, got %+v", c.User)
+	}
+
+	records, err := QueryPrivacyAuditRecords("")
+	if err != nil {
+		t.Fatal("QueryPrivacyAuditRecords", err)
+	}
+	if len(records) != 1 || records[0].Operation != PrivacyDelete || records[0].UID != "alice" || records[0].Calls != 2 {
+		t.Errorf("got audit records %+v", records)
+	}
+}
+
+func TestAnonymizeUserCalls(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	insertUserCalls(t, "alice")
+
+	n, err := AnonymizeUserCalls("alice", "admin")
+	if err != nil {
+		t.Fatal("AnonymizeUserCalls", err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 call anonymized, got %d", n)
+	}
+	c := getOnlyOneCall(t)
+	if c.User != nil || c.RemoteAddr != "" || c.UserAgent != "" || c.Tags != nil {
+		t.Errorf("call not anonymized: %+v", c)
+	}
+
+	if _, err := AnonymizeUserCalls("", "admin"); err == nil {
+		t.Error("want error for empty UID")
+	}
+}
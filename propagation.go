@@ -0,0 +1,100 @@
+package appmon
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Inject adds callID to m, the headers or attributes of a message (e.g., a
+// queued job), so that the consumer of the message can Extract it and track
+// its work as a child of the call. It is stored under the key
+// ParentCallIDHeader. If callID is 0, m is not changed.
+//
+// Producers typically inject the current call's ID (see GetCallID) or the
+// current job's ID (see Job.CallID).
+func Inject(callID int64, m map[string]string) {
+	if callID != 0 {
+		m[ParentCallIDHeader] = strconv.FormatInt(callID, 10)
+	}
+}
+
+// Extract returns the call ID added to m by Inject, to be used as the parent
+// call ID of the consumer's calls (e.g., with StartJob). The key is matched
+// case-insensitively, since some message brokers change the case of header
+// names. If m has no valid call ID, ok is false.
+func Extract(m map[string]string) (callID int64, ok bool) {
+	v, present := m[ParentCallIDHeader]
+	if !present {
+		for k, kv := range m {
+			if strings.EqualFold(k, ParentCallIDHeader) {
+				v, present = kv, true
+				break
+			}
+		}
+	}
+	if !present {
+		return 0, false
+	}
+	return parseCallID(v)
+}
+
+// InjectHeader is like Inject, for http.Header and other headers of the same
+// type (e.g., NATS message headers).
+func InjectHeader(callID int64, h http.Header) {
+	if callID != 0 {
+		h.Set(ParentCallIDHeader, strconv.FormatInt(callID, 10))
+	}
+}
+
+// ExtractHeader is like Extract, for http.Header and other headers of the
+// same type (e.g., NATS message headers).
+func ExtractHeader(h http.Header) (callID int64, ok bool) {
+	v := h.Get(ParentCallIDHeader)
+	if v == "" {
+		return 0, false
+	}
+	return parseCallID(v)
+}
+
+// InjectTable is like Inject, for headers whose values may have any type
+// (e.g., AMQP message header tables). The call ID is stored as a string.
+func InjectTable(callID int64, t map[string]interface{}) {
+	if callID != 0 {
+		t[ParentCallIDHeader] = strconv.FormatInt(callID, 10)
+	}
+}
+
+// ExtractTable is like Extract, for headers whose values may have any type
+// (e.g., AMQP message header tables). The call ID may be stored as a string,
+// byte slice or integer.
+func ExtractTable(t map[string]interface{}) (callID int64, ok bool) {
+	v, present := t[ParentCallIDHeader]
+	if !present {
+		for k, kv := range t {
+			if strings.EqualFold(k, ParentCallIDHeader) {
+				v, present = kv, true
+				break
+			}
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return parseCallID(v)
+	case []byte:
+		return parseCallID(string(v))
+	case int64:
+		return v, v > 0
+	case int32:
+		return int64(v), v > 0
+	case int:
+		return int64(v), v > 0
+	}
+	return 0, false
+}
+
+// parseCallID parses a call ID propagated as a decimal string.
+func parseCallID(s string) (int64, bool) {
+	callID, err := strconv.ParseInt(s, 10, 64)
+	return callID, err == nil && callID > 0
+}
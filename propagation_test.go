@@ -0,0 +1,58 @@
+package appmon
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestInjectExtract(t *testing.T) {
+	m := map[string]string{}
+	Inject(123, m)
+	if id, ok := Extract(m); !ok || id != 123 {
+		t.Errorf("got %d, %v; want 123, true", id, ok)
+	}
+
+	// Keys are matched case-insensitively.
+	if id, ok := Extract(map[string]string{"x-appmon-parent-call-id": "456"}); !ok || id != 456 {
+		t.Errorf("lowercase key: got %d, %v; want 456, true", id, ok)
+	}
+
+	for _, m := range []map[string]string{{}, {ParentCallIDHeader: "foo"}, {ParentCallIDHeader: "0"}} {
+		if _, ok := Extract(m); ok {
+			t.Errorf("%v: want no call ID", m)
+		}
+	}
+
+	m = map[string]string{}
+	Inject(0, m)
+	if len(m) != 0 {
+		t.Errorf("Inject(0): got %v, want empty", m)
+	}
+}
+
+func TestInjectExtractHeader(t *testing.T) {
+	h := http.Header{}
+	InjectHeader(123, h)
+	if id, ok := ExtractHeader(h); !ok || id != 123 {
+		t.Errorf("got %d, %v; want 123, true", id, ok)
+	}
+	if _, ok := ExtractHeader(http.Header{}); ok {
+		t.Error("empty header: want no call ID")
+	}
+}
+
+func TestInjectExtractTable(t *testing.T) {
+	tbl := map[string]interface{}{}
+	InjectTable(123, tbl)
+	if id, ok := ExtractTable(tbl); !ok || id != 123 {
+		t.Errorf("got %d, %v; want 123, true", id, ok)
+	}
+	for _, v := range []interface{}{"123", []byte("123"), int64(123), int32(123), 123} {
+		if id, ok := ExtractTable(map[string]interface{}{"x-appmon-parent-call-id": v}); !ok || id != 123 {
+			t.Errorf("%T: got %d, %v; want 123, true", v, id, ok)
+		}
+	}
+	if _, ok := ExtractTable(map[string]interface{}{ParentCallIDHeader: 1.5}); ok {
+		t.Error("float value: want no call ID")
+	}
+}
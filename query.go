@@ -0,0 +1,188 @@
+package appmon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Orders in which calls can be returned by QueryCalls.
+const (
+	SortByStart    = "start"
+	SortByDuration = "duration"
+	SortByID       = "id"
+)
+
+// DefaultCallLimit is the maximum number of calls that QueryCalls returns if
+// CallQuery.Limit is zero.
+const DefaultCallLimit = 1000
+
+// A CallQuery specifies which calls QueryCalls returns and in what order. Its
+// zero value matches all calls, most recent first, but only the first
+// DefaultCallLimit of them are returned (see Limit).
+type CallQuery struct {
+	// Filters. Zero-valued filters match all calls.
+	App          string
+	Route        string
+	Host         string
+	UID          string // user ID
+	Tenant       string
+	ParentCallID int64
+	TraceCallID  int64         // matches the call with this ID and all of its descendants
+	StatusMin    int           // minimum HTTP status code
+	StatusMax    int           // maximum HTTP status code
+	Failed       bool          // only failed calls (HTTP status code < 200 or >= 400)
+	Since        time.Time     // calls that started at or after this time
+	Until        time.Time     // calls that started before this time
+	MinDuration  time.Duration // finished calls that took at least this long
+	URLContains  string        // calls whose URL contains this substring
+
+	// RouteParams and QueryParams filter calls by parameter values. A call
+	// matches if each of the given route parameters has the given value, and
+	// each of the given querystring parameters has the given value among its
+	// values.
+	RouteParams map[string]string
+	QueryParams map[string]string
+
+	// Tags filters calls by tag values. A call matches if each of the given
+	// tags has the given value.
+	Tags map[string]string
+
+	// Sort is SortByStart (the default), SortByDuration or SortByID. Sorting
+	// by duration only returns finished calls.
+	Sort string
+
+	// Ascending sorts calls in ascending order instead of descending.
+	Ascending bool
+
+	// Limit is the maximum number of calls to return. If zero,
+	// DefaultCallLimit is used.
+	Limit int
+
+	// Cursor, if set, is the value returned by CallCursor for the last call
+	// of the previous page of results, and only calls after that call are
+	// returned.
+	Cursor string
+}
+
+// Validate returns an error if q's Sort or Cursor are invalid.
+func (q *CallQuery) Validate() error {
+	switch q.Sort {
+	case "", SortByStart, SortByDuration, SortByID:
+	default:
+		return fmt.Errorf("invalid CallQuery.Sort %q", q.Sort)
+	}
+	if q.Limit < 0 {
+		return errors.New("invalid negative CallQuery.Limit")
+	}
+	if q.Cursor != "" {
+		if _, err := q.decodeCursor(); err != nil {
+			return fmt.Errorf("invalid CallQuery.Cursor: %s", err)
+		}
+	}
+	return nil
+}
+
+func (q *CallQuery) sort() string {
+	if q.Sort == "" {
+		return SortByStart
+	}
+	return q.Sort
+}
+
+func (q *CallQuery) limit() int {
+	if q.Limit == 0 {
+		return DefaultCallLimit
+	}
+	return q.Limit
+}
+
+// callCursor identifies a call in a sorted list of calls. Val is the value
+// that the calls are sorted by.
+type callCursor struct {
+	Val interface{}
+	ID  int64
+}
+
+// CallCursor returns the cursor to set as CallQuery.Cursor to fetch the calls
+// that come after c in q's sort order.
+func (q *CallQuery) CallCursor(c *Call) string {
+	cur := callCursor{ID: c.ID}
+	switch q.sort() {
+	case SortByStart:
+		cur.Val = c.Start.In(time.UTC)
+	case SortByDuration:
+		cur.Val = int64(c.Duration() / time.Microsecond)
+	case SortByID:
+		cur.Val = c.ID
+	}
+	data, err := json.Marshal(cur)
+	if err != nil {
+		panic("CallCursor: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (q *CallQuery) decodeCursor() (*callCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	var cur struct {
+		Val json.RawMessage
+		ID  int64
+	}
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return nil, err
+	}
+
+	switch q.sort() {
+	case SortByStart:
+		var t time.Time
+		if err := json.Unmarshal(cur.Val, &t); err != nil {
+			return nil, err
+		}
+		return &callCursor{Val: t, ID: cur.ID}, nil
+	default:
+		var v int64
+		if err := json.Unmarshal(cur.Val, &v); err != nil {
+			return nil, err
+		}
+		return &callCursor{Val: v, ID: cur.ID}, nil
+	}
+}
+
+// RouteStats summarizes the finished calls to a route.
+type RouteStats struct {
+	App         string
+	Route       string
+	Count       int
+	AvgDuration time.Duration
+}
+
+// Groupings of calls by QueryUserStats.
+const (
+	GroupByUser   = "user"
+	GroupByTenant = "tenant"
+)
+
+// TagStats summarizes the finished calls with a given value of a tag.
+type TagStats struct {
+	Value       string
+	Count       int
+	Failed      int // number of failed calls (HTTP status code < 200 or >= 400)
+	AvgDuration time.Duration
+}
+
+// UserStats summarizes the finished calls made by a user (or, if grouped by
+// tenant, by all users of a tenant).
+type UserStats struct {
+	UID         string // empty if grouped by tenant
+	Name        string // empty if grouped by tenant
+	Tenant      string
+	Count       int
+	Failed      int // number of failed calls (HTTP status code < 200 or >= 400)
+	AvgDuration time.Duration
+}
@@ -0,0 +1,72 @@
+package appmon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCallQuery_Validate(t *testing.T) {
+	for _, q := range []*CallQuery{{Sort: "nope"}, {Limit: -1}, {Cursor: "!!"}, {Sort: SortByID, Cursor: (&CallQuery{}).CallCursor(&Call{ID: 1})}} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("%+v: want error", q)
+		}
+	}
+	if err := (&CallQuery{}).Validate(); err != nil {
+		t.Errorf("zero CallQuery: %s", err)
+	}
+}
+
+func TestCallQuery_CallCursor(t *testing.T) {
+	start := time.Date(2014, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	c := &Call{ID: 7, Start: start, CallStatus: CallStatus{End: NullTime{Time: start.Add(1500 * time.Microsecond), Valid: true}}}
+
+	tests := map[string]interface{}{
+		SortByStart:    start,
+		SortByDuration: int64(1500),
+		SortByID:       int64(7),
+	}
+	for sort, wantVal := range tests {
+		q := &CallQuery{Sort: sort}
+		q.Cursor = q.CallCursor(c)
+		cur, err := q.decodeCursor()
+		if err != nil {
+			t.Errorf("%s: decodeCursor: %s", sort, err)
+			continue
+		}
+		if want := (&callCursor{Val: wantVal, ID: 7}); !reflect.DeepEqual(want, cur) {
+			t.Errorf("%s: want cursor %+v, got %+v", sort, want, cur)
+		}
+	}
+}
+
+func TestCallQueryConds(t *testing.T) {
+	q := &CallQuery{
+		App:         "api",
+		TraceCallID: 3,
+		URLContains: "50%",
+		RouteParams: map[string]string{"id": "123"},
+		QueryParams: map[string]string{"q": "foo"},
+		Sort:        SortByDuration,
+	}
+	w, err := callQueryConds("appmon", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, args := w.sql()
+
+	wantSQL := `WHERE app = $1 AND id IN (
+  WITH RECURSIVE trace(id) AS (
+    SELECT $2::bigint
+    UNION
+    SELECT c.id FROM "appmon".call c JOIN trace ON c.parent_call_id = trace.id
+  )
+  SELECT id FROM trace
+) AND url LIKE $3 AND route_params @> $4::jsonb AND query_params @> $5::jsonb AND "end" IS NOT NULL`
+	if sql != wantSQL {
+		t.Errorf("want SQL %q, got %q", wantSQL, sql)
+	}
+	if want := []interface{}{"api", int64(3), `%50\%%`, `{"id":"123"}`, `{"q":["foo"]}`}; !reflect.DeepEqual(want, args) {
+		t.Errorf("want args %v, got %v", want, args)
+	}
+}
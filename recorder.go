@@ -43,3 +43,10 @@ func (rw *responseRecorder) WriteHeader(code int) {
 func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return rw.underlying.(http.Hijacker).Hijack()
 }
+
+// Flush implements http.Flusher, so that streaming handlers can be tracked.
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.underlying.(http.Flusher); ok {
+		f.Flush()
+	}
+}
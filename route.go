@@ -0,0 +1,133 @@
+package appmon
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// A RouteResolver determines the route that a request matched, so that calls
+// can be grouped by route.
+type RouteResolver interface {
+	// ResolveRoute returns the name or path template of the route that r
+	// matched (e.g., "/users/{id}") and the values of the route's
+	// parameters. If the resolver can't determine r's route, ok is false.
+	ResolveRoute(r *http.Request) (route string, params map[string]string, ok bool)
+}
+
+// RouteResolverFunc is an adapter to allow the use of ordinary functions as
+// RouteResolvers.
+type RouteResolverFunc func(r *http.Request) (route string, params map[string]string, ok bool)
+
+// ResolveRoute calls f(r).
+func (f RouteResolverFunc) ResolveRoute(r *http.Request) (string, map[string]string, bool) {
+	return f(r)
+}
+
+// RouteResolvers are tried, in order, to determine the route of each call
+// (unless the Monitor tracking it has its own RouteResolvers). The first
+// resolver that resolves a request's route is used. Calls whose route isn't
+// resolved are recorded with an empty route; to group them by URL path
+// instead, append PathTemplateRouteResolver.
+var RouteResolvers = []RouteResolver{MuxRouteResolver, ServeMuxRouteResolver}
+
+// MuxRouteResolver resolves routes of requests routed by a gorilla/mux
+// Router. The route is the mux route's name, which is empty for unnamed
+// routes; to group calls to unnamed routes by their path templates instead,
+// replace it in RouteResolvers with MuxPathTemplateRouteResolver.
+var MuxRouteResolver RouteResolver = muxRouteResolver(false)
+
+// MuxPathTemplateRouteResolver is like MuxRouteResolver, except that the
+// route of a request that matched an unnamed mux route is the route's path
+// template (e.g., "/users/{id}").
+var MuxPathTemplateRouteResolver RouteResolver = muxRouteResolver(true)
+
+func muxRouteResolver(pathTemplate bool) RouteResolver {
+	return RouteResolverFunc(func(r *http.Request) (string, map[string]string, bool) {
+		rt := mux.CurrentRoute(r)
+		if rt == nil {
+			return "", nil, false
+		}
+		name := rt.GetName()
+		if name == "" && pathTemplate {
+			name, _ = rt.GetPathTemplate()
+		}
+		return name, mux.Vars(r), true
+	})
+}
+
+// ServeMuxRouteResolver resolves routes of requests routed by a
+// net/http.ServeMux. The route is the pattern that the request matched (e.g.,
+// "GET /users/{id}"), and the route parameters are the pattern's wildcards.
+var ServeMuxRouteResolver RouteResolver = RouteResolverFunc(func(r *http.Request) (string, map[string]string, bool) {
+	if r.Pattern == "" {
+		return "", nil, false
+	}
+	var params map[string]string
+	for _, name := range patternWildcards(r.Pattern) {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = r.PathValue(name)
+	}
+	return r.Pattern, params, true
+})
+
+// patternWildcards returns the names of the wildcards (e.g., "{id}" or
+// "{path...}") in a ServeMux pattern.
+func patternWildcards(pattern string) (names []string) {
+	for _, seg := range strings.Split(pattern, "/") {
+		if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") {
+			continue
+		}
+		name := strings.TrimSuffix(seg[1:len(seg)-1], "...")
+		if name != "" && name != "$" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// PathTemplateRouteResolver resolves the route of any request to a template
+// derived from its URL path, with numeric path segments replaced by "{id}"
+// and UUID path segments replaced by "{uuid}" (e.g., "/users/123/edit"
+// becomes "/users/{id}/edit"). It returns no route parameters.
+//
+// It is meant as a fallback for requests that weren't routed by a known
+// router, and isn't used unless it's added to RouteResolvers (or a Monitor's
+// RouteResolvers). Applications whose URLs contain other kinds of identifiers
+// (e.g., user names) should use a more specific RouteResolver, since each
+// distinct path is otherwise recorded as a separate route.
+var PathTemplateRouteResolver RouteResolver = RouteResolverFunc(func(r *http.Request) (string, map[string]string, bool) {
+	if r.URL == nil {
+		return "", nil, false
+	}
+	segs := strings.Split(r.URL.Path, "/")
+	for i, seg := range segs {
+		switch {
+		case numericSegment.MatchString(seg):
+			segs[i] = "{id}"
+		case uuidSegment.MatchString(seg):
+			segs[i] = "{uuid}"
+		}
+	}
+	return strings.Join(segs, "/"), nil, true
+})
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// resolveRoute returns r's route and route parameters as determined by the
+// first of resolvers that resolves it.
+func resolveRoute(resolvers []RouteResolver, r *http.Request) (string, map[string]string) {
+	for _, rr := range resolvers {
+		if route, params, ok := rr.ResolveRoute(r); ok {
+			return route, params
+		}
+	}
+	return "", nil
+}
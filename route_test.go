@@ -0,0 +1,142 @@
+package appmon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// trackedRoute serves r with h wrapped by a Monitor with the given
+// RouteResolvers and returns the tracked call.
+func trackedRoute(t *testing.T, resolvers []RouteResolver, h func(tracked http.Handler) http.Handler, r *http.Request) *Call {
+	var obs callRecorder
+	m := &Monitor{RouteResolvers: resolvers, Observers: []Observer{&obs}, Live: &Hub{}}
+	h(m.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).ServeHTTP(httptest.NewRecorder(), r)
+	if len(obs.calls) != 1 {
+		t.Fatalf("got %d calls, want 1", len(obs.calls))
+	}
+	return obs.calls[0]
+}
+
+func TestRouteResolvers(t *testing.T) {
+	tests := []struct {
+		name       string
+		resolvers  []RouteResolver // if nil, the global RouteResolvers
+		handler    func(tracked http.Handler) http.Handler
+		url        string
+		wantRoute  string
+		wantParams Params
+	}{
+		{
+			name: "mux named route",
+			handler: func(h http.Handler) http.Handler {
+				rt := mux.NewRouter()
+				rt.Path("/users/{id}").Handler(h).Name("user")
+				return rt
+			},
+			url:        "/users/123",
+			wantRoute:  "user",
+			wantParams: Params{"id": "123"},
+		},
+		{
+			name: "mux unnamed route",
+			handler: func(h http.Handler) http.Handler {
+				rt := mux.NewRouter()
+				rt.Path("/users/{id}").Handler(h)
+				return rt
+			},
+			url:        "/users/123",
+			wantRoute:  "",
+			wantParams: Params{"id": "123"},
+		},
+		{
+			name:      "mux unnamed route with path template resolver",
+			resolvers: []RouteResolver{MuxPathTemplateRouteResolver},
+			handler: func(h http.Handler) http.Handler {
+				rt := mux.NewRouter()
+				rt.Path("/users/{id}").Handler(h)
+				return rt
+			},
+			url:        "/users/123",
+			wantRoute:  "/users/{id}",
+			wantParams: Params{"id": "123"},
+		},
+		{
+			name:      "mux named route with path template resolver",
+			resolvers: []RouteResolver{MuxPathTemplateRouteResolver},
+			handler: func(h http.Handler) http.Handler {
+				rt := mux.NewRouter()
+				rt.Path("/users/{id}").Handler(h).Name("user")
+				return rt
+			},
+			url:        "/users/123",
+			wantRoute:  "user",
+			wantParams: Params{"id": "123"},
+		},
+		{
+			name: "ServeMux pattern",
+			handler: func(h http.Handler) http.Handler {
+				mux := http.NewServeMux()
+				mux.Handle("GET /users/{id}/files/{path...}", h)
+				return mux
+			},
+			url:        "/users/123/files/a/b",
+			wantRoute:  "GET /users/{id}/files/{path...}",
+			wantParams: Params{"id": "123", "path": "a/b"},
+		},
+		{
+			name: "ServeMux pattern without wildcards",
+			handler: func(h http.Handler) http.Handler {
+				mux := http.NewServeMux()
+				mux.Handle("/{$}", h)
+				return mux
+			},
+			url:        "/",
+			wantRoute:  "/{$}",
+			wantParams: Params{},
+		},
+		{
+			name:       "not routed",
+			handler:    func(h http.Handler) http.Handler { return h },
+			url:        "/users/123",
+			wantRoute:  "",
+			wantParams: Params{},
+		},
+	}
+	for _, test := range tests {
+		c := trackedRoute(t, test.resolvers, test.handler, httptest.NewRequest("GET", test.url, nil))
+		if c.Route != test.wantRoute {
+			t.Errorf("%s: got route %q, want %q", test.name, c.Route, test.wantRoute)
+		}
+		if !reflect.DeepEqual(c.RouteParams, test.wantParams) {
+			t.Errorf("%s: got route params %v, want %v", test.name, c.RouteParams, test.wantParams)
+		}
+	}
+}
+
+func TestPathTemplateRouteResolver(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users/123/sessions/0F8FAD5B-D9CB-469F-A165-70867728950E/edit", nil)
+	route, params, ok := PathTemplateRouteResolver.ResolveRoute(r)
+	if want := "/users/{id}/sessions/{uuid}/edit"; !ok || route != want || params != nil {
+		t.Errorf("got route %q, params %v, ok %v, want route %q", route, params, ok, want)
+	}
+}
+
+func TestMonitor_RouteResolvers(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{
+		RouteResolvers: []RouteResolver{
+			RouteResolverFunc(func(r *http.Request) (string, map[string]string, bool) { return "", nil, false }),
+			RouteResolverFunc(func(r *http.Request) (string, map[string]string, bool) { return "custom", nil, true }),
+		},
+		Observers: []Observer{&obs},
+		Live:      &Hub{},
+	}
+	m.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	if len(obs.calls) != 1 || obs.calls[0].Route != "custom" {
+		t.Errorf("got calls %+v, want 1 call with route %q", obs.calls, "custom")
+	}
+}
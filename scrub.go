@@ -0,0 +1,295 @@
+package appmon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// A Scrubber removes sensitive information, such as personally identifiable
+// information (PII) and credentials, from a call before it is stored or passed
+// to observers.
+//
+// Calls are scrubbed when they start. Fields that are set while a call is
+// handled (its Tags and Log) are scrubbed again when it finishes: the
+// Scrubbers are applied to a Call that holds only those fields.
+type Scrubber interface {
+	Scrub(c *Call)
+}
+
+// ScrubberFunc is an adapter to allow the use of ordinary functions as
+// Scrubbers.
+type ScrubberFunc func(c *Call)
+
+// Scrub calls f(c).
+func (f ScrubberFunc) Scrub(c *Call) { f(c) }
+
+// Scrubbers are applied, in order, to each call tracked without a Monitor in
+// BeforeAPICall. No calls are scrubbed by default; to scrub PII from calls, add
+// a PIIScrubber (see NewPIIScrubber), and to anonymize client IP addresses, add
+// an IPAnonymizer.
+var Scrubbers []Scrubber
+
+// A Detector finds sensitive values in strings.
+type Detector struct {
+	// Name describes the kind of value (e.g., "email"). It is included in
+	// the replacements of scrubbed values.
+	Name string
+
+	// Pattern matches candidate sensitive values.
+	Pattern *regexp.Regexp
+
+	// Valid, if set, is called on each match of Pattern and returns whether
+	// it's really a sensitive value (e.g., by checking a checksum).
+	Valid func(s string) bool
+}
+
+// Built-in detectors.
+var (
+	EmailDetector = &Detector{
+		Name:    "email",
+		Pattern: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	}
+	CreditCardDetector = &Detector{
+		Name:    "card",
+		Pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		Valid:   luhnValid,
+	}
+	JWTDetector = &Detector{
+		Name:    "jwt",
+		Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`),
+	}
+)
+
+// DefaultSensitiveParams are the names of route and querystring parameters
+// whose values NewPIIScrubber scrubs regardless of their contents.
+var DefaultSensitiveParams = []string{
+	"password", "passwd", "secret", "token", "access_token", "refresh_token", "id_token",
+	"api_key", "apikey", "key", "code", "reset_code", "auth", "authorization", "session", "sessionid", "sid",
+}
+
+// A PIIScrubber replaces sensitive values in a call's URL, RouteParams,
+// QueryParams, Tags, UserAgent and Log with stable hashes, so that calls with
+// the same value can still be correlated. Values are sensitive if they are
+// found by one of Detectors or are the value of a parameter named in
+// ParamNames.
+type PIIScrubber struct {
+	// Detectors find sensitive substrings.
+	Detectors []*Detector
+
+	// ParamNames are the names of parameters whose values are always
+	// scrubbed. Names are matched case-insensitively.
+	ParamNames []string
+
+	// Key is the HMAC-SHA256 key used to hash sensitive values. If empty,
+	// values are hashed with unkeyed SHA-256, which makes it possible to
+	// confirm guesses of low-entropy values (such as emails); set a secret Key
+	// in production.
+	Key []byte
+}
+
+// NewPIIScrubber returns a PIIScrubber with the built-in detectors and
+// DefaultSensitiveParams that hashes values with key.
+func NewPIIScrubber(key []byte) *PIIScrubber {
+	return &PIIScrubber{
+		Detectors:  []*Detector{EmailDetector, CreditCardDetector, JWTDetector},
+		ParamNames: DefaultSensitiveParams,
+		Key:        key,
+	}
+}
+
+// Scrub implements Scrubber. It replaces c's params, tags and log lines with
+// scrubbed copies, so maps and slices shared with the caller (e.g., a job's
+// arguments) aren't modified.
+func (s *PIIScrubber) Scrub(c *Call) {
+	var pathValues []string
+	for k, v := range c.RouteParams {
+		if sv, ok := v.(string); ok && sv != "" && s.sensitiveParam(k) {
+			pathValues = append(pathValues, sv)
+		}
+	}
+	c.RouteParams = s.scrubParams(c.RouteParams)
+	c.QueryParams = s.scrubParams(c.QueryParams)
+	c.Tags = s.scrubParams(c.Tags)
+	c.URL = s.scrubURL(c.URL, pathValues)
+	c.UserAgent = s.scrubString(c.UserAgent)
+	if c.Log != nil {
+		lines := make([]string, len(c.Log))
+		for i, line := range c.Log {
+			lines[i] = s.scrubLogLine(line)
+		}
+		c.Log = lines
+	}
+}
+
+// scrubParams returns a copy of params with sensitive parameters' values
+// hashed and detected values in other parameters' values scrubbed.
+func (s *PIIScrubber) scrubParams(params Params) Params {
+	if params == nil {
+		return nil
+	}
+	scrubbed := make(Params, len(params))
+	for k, v := range params {
+		if s.sensitiveParam(k) {
+			scrubbed[k] = s.scrubParamValue(v, s.hashValue)
+		} else {
+			scrubbed[k] = s.scrubParamValue(v, s.scrubString)
+		}
+	}
+	return scrubbed
+}
+
+// logCallID matches the call ID that the loggers returned by Logger and
+// LogHandler add to each log entry.
+var logCallID = regexp.MustCompile(`\b` + CallIDLogKey + `=[0-9]+`)
+
+// scrubLogLine scrubs a captured log line, except for its call IDs (which may
+// look like, e.g., card numbers).
+func (s *PIIScrubber) scrubLogLine(line string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range logCallID.FindAllStringIndex(line, -1) {
+		b.WriteString(s.scrubString(line[last:m[0]]))
+		b.WriteString(line[m[0]:m[1]])
+		last = m[1]
+	}
+	b.WriteString(s.scrubString(line[last:]))
+	return b.String()
+}
+
+func (s *PIIScrubber) sensitiveParam(name string) bool {
+	for _, p := range s.ParamNames {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubParamValue applies f to the param value v, which is a string or a list
+// of strings.
+func (s *PIIScrubber) scrubParamValue(v interface{}, f func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return f(v)
+	case []string:
+		t := make([]string, len(v))
+		for i, sv := range v {
+			t[i] = f(sv)
+		}
+		return t
+	case []interface{}:
+		t := make([]interface{}, len(v))
+		for i, iv := range v {
+			t[i] = s.scrubParamValue(iv, f)
+		}
+		return t
+	}
+	return v
+}
+
+// scrubURL scrubs the querystring parameters of the URL rawurl, path segments
+// equal to the given route param values, and detected values from its path and
+// fragment. Passwords in the URL's user info are also scrubbed.
+func (s *PIIScrubber) scrubURL(rawurl string, pathValues []string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return s.scrubString(rawurl)
+	}
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(s.scrubString(u.User.Username()), s.hashValue(p))
+		} else {
+			u.User = url.User(s.scrubString(u.User.Username()))
+		}
+	}
+	segs := strings.Split(u.Path, "/")
+	for i, seg := range segs {
+		for _, v := range pathValues {
+			if seg == v {
+				segs[i] = s.hashValue(v)
+			}
+		}
+	}
+	if path := s.scrubString(strings.Join(segs, "/")); path != u.Path {
+		u.Path, u.RawPath = path, ""
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k, vs := range q {
+			for i, v := range vs {
+				if s.sensitiveParam(k) {
+					vs[i] = s.hashValue(v)
+				} else {
+					vs[i] = s.scrubString(v)
+				}
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	u.Fragment = s.scrubString(u.Fragment)
+	return u.String()
+}
+
+// scrubString replaces the substrings of str found by s.Detectors with their
+// hashes.
+func (s *PIIScrubber) scrubString(str string) string {
+	for _, d := range s.Detectors {
+		str = d.Pattern.ReplaceAllStringFunc(str, func(m string) string {
+			if d.Valid != nil && !d.Valid(m) {
+				return m
+			}
+			return s.hash(d.Name, m)
+		})
+	}
+	return str
+}
+
+// hashValue returns the replacement of a sensitive parameter value. Empty
+// values and values that were already scrubbed (e.g., tags scrubbed when their
+// call started and again when it finished) are left as-is.
+func (s *PIIScrubber) hashValue(v string) string {
+	if v == "" || strings.HasPrefix(v, "scrubbed_") {
+		return v
+	}
+	return s.hash("param", v)
+}
+
+// hash returns a stable replacement for the sensitive value v of the named
+// kind, such as "scrubbed_email_1a2b3c4d5e6f". Replacements only contain
+// characters that don't need to be escaped in URLs.
+func (s *PIIScrubber) hash(kind, v string) string {
+	var sum []byte
+	if len(s.Key) > 0 {
+		mac := hmac.New(sha256.New, s.Key)
+		mac.Write([]byte(v))
+		sum = mac.Sum(nil)
+	} else {
+		h := sha256.Sum256([]byte(v))
+		sum = h[:]
+	}
+	return "scrubbed_" + kind + "_" + hex.EncodeToString(sum[:6])
+}
+
+// luhnValid returns whether the digits in s have a valid Luhn checksum, as
+// credit card numbers do. Non-digits are ignored.
+func luhnValid(s string) bool {
+	var sum, n int
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && n <= 19 && sum%10 == 0
+}
@@ -0,0 +1,97 @@
+package appmon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPIIScrubber(t *testing.T) {
+	s := NewPIIScrubber([]byte("k"))
+	email := s.hash("email", "alice@example.com")
+	card := s.hash("card", "4111 1111 1111 1111")
+	jwt := s.hash("jwt", "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln")
+	token := s.hash("param", "abc123")
+
+	c := &Call{
+		URL:         "http://example.com/users/alice@example.com/reset/abc123?token=abc123&q=hello&card=4111+1111+1111+1111",
+		UserAgent:   "Mozilla/5.0 (alice@example.com)",
+		RouteParams: Params{"user": "alice@example.com", "token": "abc123"},
+		QueryParams: Params{
+			"token": []string{"abc123"},
+			"q":     []string{"hello"},
+			"card":  []string{"4111 1111 1111 1111"},
+			"auth":  []string{"eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln"},
+			"id":    []string{"4111111111111112"}, // fails Luhn check
+		},
+	}
+	s.Scrub(c)
+
+	wantURL := "http://example.com/users/" + email + "/reset/" + token + "?card=" + card + "&q=hello&token=" + token
+	if c.URL != wantURL {
+		t.Errorf("got URL %q, want %q", c.URL, wantURL)
+	}
+	if want := "Mozilla/5.0 (" + email + ")"; c.UserAgent != want {
+		t.Errorf("got UserAgent %q, want %q", c.UserAgent, want)
+	}
+	if want := (Params{"user": email, "token": token}); !reflect.DeepEqual(c.RouteParams, want) {
+		t.Errorf("got RouteParams %v, want %v", c.RouteParams, want)
+	}
+	wantQuery := Params{
+		"token": []string{token},
+		"q":     []string{"hello"},
+		"card":  []string{card},
+		"auth":  []string{s.hash("param", "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln")},
+		"id":    []string{"4111111111111112"},
+	}
+	if !reflect.DeepEqual(c.QueryParams, wantQuery) {
+		t.Errorf("got QueryParams %v, want %v", c.QueryParams, wantQuery)
+	}
+
+	// JWTs are detected in values of params that aren't sensitive by name.
+	if got := s.scrubString("t=eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln"); got != "t="+jwt {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestPIIScrubber_StableHashes(t *testing.T) {
+	a, b := NewPIIScrubber([]byte("k1")), NewPIIScrubber([]byte("k2"))
+	if a.hash("email", "x") != a.hash("email", "x") {
+		t.Error("hashes of the same value differ")
+	}
+	if a.hash("email", "x") == a.hash("email", "y") {
+		t.Error("hashes of different values are equal")
+	}
+	if a.hash("email", "x") == b.hash("email", "x") {
+		t.Error("hashes with different keys are equal")
+	}
+	if h := a.hash("email", "x"); !strings.HasPrefix(h, "scrubbed_email_") {
+		t.Errorf("got hash %q", h)
+	}
+}
+
+func TestScrubbers(t *testing.T) {
+	m := &Monitor{Scrubbers: []Scrubber{
+		ScrubberFunc(func(c *Call) { c.UserAgent = "" }),
+		ScrubberFunc(func(c *Call) { c.URL += "#scrubbed" }),
+	}}
+
+	c := &Call{URL: "/foo", UserAgent: "ua"}
+	m.scrub(c)
+	if c.URL != "/foo#scrubbed" || c.UserAgent != "" {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	for s, want := range map[string]bool{
+		"4111111111111111":    true,
+		"4111 1111 1111 1111": true,
+		"4111111111111112":    false,
+		"79927398713":         false, // valid checksum, but too short
+	} {
+		if got := luhnValid(s); got != want {
+			t.Errorf("luhnValid(%q): want %v, got %v", s, want, got)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package appmon
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStatsDPacketSize is the default maximum size of a StatsD UDP packet.
+// It fits in a single Ethernet frame along with the IP and UDP headers.
+const DefaultStatsDPacketSize = 1432
+
+// DefaultStatsDFlushInterval is the default interval at which buffered
+// StatsD metrics are sent.
+const DefaultStatsDFlushInterval = time.Second
+
+// StatsDOptions configures a StatsD emitter.
+type StatsDOptions struct {
+	// Prefix is prepended to all metric names (e.g., "myapp.").
+	Prefix string
+
+	// DogStatsD enables DogStatsD-style tags. If true, the app, route, HTTP
+	// method and status are sent as tags; otherwise they are encoded in the
+	// metric names, as plain StatsD has no tags.
+	DogStatsD bool
+
+	// Tags are extra "key:value" tags added to every metric. They are only
+	// sent if DogStatsD is true.
+	Tags []string
+
+	// MaxPacketSize is the maximum size of a UDP packet. Metrics are batched
+	// into packets of up to this size. If zero, DefaultStatsDPacketSize is
+	// used.
+	MaxPacketSize int
+
+	// FlushInterval is how often partially filled packets are sent. If zero,
+	// DefaultStatsDFlushInterval is used.
+	FlushInterval time.Duration
+}
+
+// StatsD is an Observer that sends a counter and a timing metric for each
+// finished call to a StatsD (or DogStatsD) server over UDP. With the default
+// options, a call to route "get-user" in app "api" that returned 200 produces:
+//
+//	calls.api.get-user.GET.200:1|c
+//	call_duration.api.get-user.GET.200:12.5|ms
+//
+// and with DogStatsD enabled:
+//
+//	calls:1|c|#app:api,route:get-user,method:GET,status:200,status_class:2xx
+//	call_duration:12.5|ms|#app:api,route:get-user,method:GET,status:200,status_class:2xx
+type StatsD struct {
+	opt  StatsDOptions
+	conn net.Conn
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	closed  bool
+	dropped int64
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewStatsD returns a StatsD emitter that sends metrics to the server at addr
+// (e.g., "127.0.0.1:8125"). Callers should add it to Observers and call Close
+// on shutdown to send any buffered metrics. The metrics of calls that finish
+// after Close are dropped (see Dropped).
+func NewStatsD(addr string, opt StatsDOptions) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if opt.MaxPacketSize == 0 {
+		opt.MaxPacketSize = DefaultStatsDPacketSize
+	}
+	if opt.FlushInterval == 0 {
+		opt.FlushInterval = DefaultStatsDFlushInterval
+	}
+	s := &StatsD{opt: opt, conn: conn, done: make(chan struct{})}
+	s.wg.Add(1)
+	go s.flushLoop()
+	return s, nil
+}
+
+// CallStarted implements Observer.
+func (s *StatsD) CallStarted(c *Call) {}
+
+// CallFinished implements Observer.
+func (s *StatsD) CallFinished(c *Call) {
+	ms := strconv.FormatFloat(float64(c.Duration())/float64(time.Millisecond), 'f', -1, 64)
+	route := c.Route
+	if route == "" {
+		route = "unnamed"
+	}
+	method, status := metricsMethod(c.HTTPMethod), strconv.Itoa(c.HTTPStatusCode)
+
+	var counter, timing string
+	if s.opt.DogStatsD {
+		tags := make([]string, 0, len(s.opt.Tags)+5)
+		tags = append(tags, s.opt.Tags...)
+		tags = append(tags,
+			"app:"+statsdTagValue(c.App),
+			"route:"+statsdTagValue(route),
+			"method:"+method,
+			"status:"+status,
+			"status_class:"+statusClass(c.HTTPStatusCode),
+		)
+		suffix := "|#" + strings.Join(tags, ",")
+		counter = s.opt.Prefix + "calls:1|c" + suffix
+		timing = s.opt.Prefix + "call_duration:" + ms + "|ms" + suffix
+	} else {
+		name := "." + statsdName(c.App) + "." + statsdName(route) + "." + method + "." + status
+		counter = s.opt.Prefix + "calls" + name + ":1|c"
+		timing = s.opt.Prefix + "call_duration" + name + ":" + ms + "|ms"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		s.dropped++
+		return
+	}
+	s.add(counter)
+	s.add(timing)
+}
+
+// Dropped returns the number of calls whose metrics were dropped because they
+// finished after Close.
+func (s *StatsD) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// add appends a metric line to the current packet, sending the packet first
+// if the line wouldn't fit. s.mu must be held.
+func (s *StatsD) add(line string) {
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > s.opt.MaxPacketSize {
+		s.send()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+// send sends and resets the current packet. s.mu must be held.
+func (s *StatsD) send() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		log.Printf("StatsD: send failed: %s", err)
+	}
+	s.buf.Reset()
+}
+
+// Flush sends any buffered metrics.
+func (s *StatsD) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send()
+}
+
+func (s *StatsD) flushLoop() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.opt.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close sends any buffered metrics and closes the connection. Calling Close
+// more than once has no further effect.
+func (s *StatsD) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.send()
+		s.closed = true
+		s.closeErr = s.conn.Close()
+	})
+	return s.closeErr
+}
+
+// statsdName makes s safe to use as a component of a dotted StatsD metric
+// name.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// statsdTagValue makes s safe to use as a DogStatsD tag value.
+func statsdTagValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,112 @@
+package appmon
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdListen starts a UDP listener and returns it along with a function that
+// reads the next packet from it.
+func statsdListen(t *testing.T) (*net.UDPConn, func() string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("ListenUDP", err)
+	}
+	return conn, func() string {
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal("Read", err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	conn, read := statsdListen(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), StatsDOptions{Prefix: "myapp.", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CallFinished(makeFinishedCall("api", "get.user", "GET", 200, 12500*time.Microsecond))
+	s.Close()
+
+	want := []string{
+		"myapp.calls.api.get_user.GET.200:1|c",
+		"myapp.call_duration.api.get_user.GET.200:12.5|ms",
+	}
+	if got := strings.Split(read(), "\n"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStatsD_DogStatsD(t *testing.T) {
+	conn, read := statsdListen(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), StatsDOptions{DogStatsD: true, Tags: []string{"env:test"}, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CallFinished(makeFinishedCall("api", "", "POST", 503, time.Millisecond))
+	s.Close()
+
+	tags := "|#env:test,app:api,route:unnamed,method:POST,status:503,status_class:5xx"
+	want := []string{"calls:1|c" + tags, "call_duration:1|ms" + tags}
+	if got := strings.Split(read(), "\n"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStatsD_Batching(t *testing.T) {
+	conn, read := statsdListen(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), StatsDOptions{MaxPacketSize: 100, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.CallFinished(makeFinishedCall("api", "r", "GET", 200, time.Millisecond))
+	}
+	s.Close()
+
+	var lines int
+	for lines < 10 {
+		p := read()
+		if len(p) > 100 {
+			t.Errorf("packet exceeds MaxPacketSize: %d bytes", len(p))
+		}
+		lines += len(strings.Split(p, "\n"))
+	}
+	if lines != 10 {
+		t.Errorf("want 10 lines, got %d", lines)
+	}
+}
+
+func TestStatsD_Close(t *testing.T) {
+	conn, _ := statsdListen(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String(), StatsDOptions{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close: %s", err)
+	}
+	s.CallFinished(makeFinishedCall("api", "r", "GET", 200, time.Millisecond))
+	s.Flush()
+	if got := s.Dropped(); got != 1 {
+		t.Errorf("got %d dropped, want 1", got)
+	}
+}
@@ -0,0 +1,88 @@
+package appmon
+
+import "io"
+
+// A Store stores tracked calls in a PostgreSQL database schema. Multiple
+// Stores with different schemas may be used in the same process (e.g., one
+// per Monitor).
+type Store struct {
+	// DB is the database handle.
+	DB DBH
+
+	// Schema is the name of the PostgreSQL database schema that contains
+	// the store's tables. It is double-quoted in SQL statements sent to the
+	// database but not escaped.
+	Schema string
+}
+
+// defaultStore returns the Store for the global DB and DBSchema.
+func defaultStore() *Store {
+	return &Store{DB: DB, Schema: DBSchema}
+}
+
+// The functions below operate on the Store for the global DB and DBSchema.
+
+// InitDBSchema creates the database schema (if it doesn't exist) and applies
+// all pending migrations to it.
+func InitDBSchema() error { return defaultStore().InitSchema() }
+
+// DropDBSchema drops the database schema and tables.
+func DropDBSchema() error { return defaultStore().DropSchema() }
+
+// MigrateDB applies all pending migrations to the database schema. See
+// Store.Migrate.
+func MigrateDB() error { return defaultStore().Migrate() }
+
+// SchemaVersion returns the version of the last migration applied to the
+// database schema, or 0 if none have been applied.
+func SchemaVersion() (int, error) { return defaultStore().SchemaVersion() }
+
+// PendingMigrations returns the migrations that have not yet been applied to
+// the database schema.
+func PendingMigrations() ([]Migration, error) { return defaultStore().PendingMigrations() }
+
+// QueryCalls returns the calls matching q. See Store.QueryCalls.
+func QueryCalls(q *CallQuery) ([]*Call, error) { return defaultStore().QueryCalls(q) }
+
+// QueryRouteStats returns per-route statistics for the calls matching q.
+func QueryRouteStats(q *CallQuery) ([]*RouteStats, error) { return defaultStore().QueryRouteStats(q) }
+
+// QueryUserStats returns per-user or per-tenant statistics for the calls
+// matching q. See Store.QueryUserStats.
+func QueryUserStats(q *CallQuery, groupBy string) ([]*UserStats, error) {
+	return defaultStore().QueryUserStats(q, groupBy)
+}
+
+// QueryTagStats returns per-value statistics of the tag key for the calls
+// matching q. See Store.QueryTagStats.
+func QueryTagStats(q *CallQuery, key string) ([]*TagStats, error) {
+	return defaultStore().QueryTagStats(q, key)
+}
+
+// CheckQueryPlans checks whether the panel's common queries would fall back to
+// sequential scans of the call table. See Store.CheckQueryPlans.
+func CheckQueryPlans() ([]*PlanWarning, error) { return defaultStore().CheckQueryPlans() }
+
+// ExportUserCalls writes all stored calls made by the user with the given ID
+// to w. See Store.ExportUserCalls.
+func ExportUserCalls(w io.Writer, uid, actor string) (int64, error) {
+	return defaultStore().ExportUserCalls(w, uid, actor)
+}
+
+// DeleteUserCalls deletes all stored calls made by the user with the given ID.
+// See Store.DeleteUserCalls.
+func DeleteUserCalls(uid, actor string) (int64, error) {
+	return defaultStore().DeleteUserCalls(uid, actor)
+}
+
+// AnonymizeUserCalls removes the user's identity from all stored calls made by
+// the user with the given ID. See Store.AnonymizeUserCalls.
+func AnonymizeUserCalls(uid, actor string) (int64, error) {
+	return defaultStore().AnonymizeUserCalls(uid, actor)
+}
+
+// QueryPrivacyAuditRecords returns the privacy audit records for the user with
+// the given ID, or for all users if uid is empty, most recent first.
+func QueryPrivacyAuditRecords(uid string) ([]*PrivacyAuditRecord, error) {
+	return defaultStore().QueryPrivacyAuditRecords(uid)
+}
@@ -0,0 +1,31 @@
+package appmon
+
+import "net/http"
+
+// SetTag sets the tag key to value on the call being tracked for r (see
+// Call.Tags), replacing any previous value. Tags set while the call is being
+// handled are stored when it finishes. SetTag has no effect if no call is
+// being tracked for r (e.g., because r wasn't sampled). It must not be called
+// concurrently for the same request.
+func SetTag(r *http.Request, key, value string) {
+	if c, ok := getCall(r); ok {
+		c.SetTag(key, value)
+	}
+}
+
+// SetTag sets the tag key to value on the job's call. See SetTag.
+func (j *Job) SetTag(key, value string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.c.SetTag(key, value)
+}
+
+// SetTag sets the tag key to value on c, replacing any previous value. It is
+// for integrations that track calls with Monitor.StartCall; applications
+// should use the package-level SetTag (or Job.SetTag) instead.
+func (c *Call) SetTag(key, value string) {
+	if c.Tags == nil {
+		c.Tags = make(Params)
+	}
+	c.Tags[key] = value
+}
@@ -0,0 +1,102 @@
+package appmon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSetTag(t *testing.T) {
+	var obs callRecorder
+	m := &Monitor{Observers: []Observer{&obs}, Live: &Hub{}}
+	m.TrackAPICall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetTag(r, "plan", "free")
+		SetTag(r, "plan", "pro")
+		SetTag(r, "variant", "b")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	j := m.StartJob("job", 0, nil)
+	j.SetTag("queue", "email")
+	j.Finish(nil)
+
+	if len(obs.calls) != 2 {
+		t.Fatalf("got %d calls, want 2", len(obs.calls))
+	}
+	if want := (Params{"plan": "pro", "variant": "b"}); !reflect.DeepEqual(obs.calls[0].Tags, want) {
+		t.Errorf("got tags %v, want %v", obs.calls[0].Tags, want)
+	}
+	if want := (Params{"queue": "email"}); !reflect.DeepEqual(obs.calls[1].Tags, want) {
+		t.Errorf("got job tags %v, want %v", obs.calls[1].Tags, want)
+	}
+
+	// SetTag on an untracked request has no effect.
+	SetTag(httptest.NewRequest("GET", "/", nil), "k", "v")
+}
+
+func TestFinishCall_ScrubsTags(t *testing.T) {
+	var obs callRecorder
+	s := NewPIIScrubber([]byte("k"))
+	m := &Monitor{Observers: []Observer{&obs}, Scrubbers: []Scrubber{s}, Live: &Hub{}}
+
+	c := &Call{Tags: Params{"token": "abc123"}}
+	m.StartCall(c)
+	c.SetTag("customer", "alice@example.com")
+	m.FinishCall(c, CallStatus{HTTPStatusCode: 200})
+
+	want := Params{"token": s.hash("param", "abc123"), "customer": s.hash("email", "alice@example.com")}
+	if !reflect.DeepEqual(c.Tags, want) {
+		t.Errorf("got tags %v, want %v", c.Tags, want)
+	}
+}
+
+func TestQueryTagStats(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	for i, plan := range []string{"pro", "free", "pro", ""} {
+		c := makeCall()
+		c.Tags = nil
+		if plan != "" {
+			c.Tags = Params{"plan": plan}
+		}
+		c.HTTPStatusCode = 200 + 300*(i%2)
+		if err := defaultStore().insertCall(c); err != nil {
+			t.Fatal("insertCall", err)
+		}
+	}
+
+	stats, err := QueryTagStats(&CallQuery{}, "plan")
+	if err != nil {
+		t.Fatal("QueryTagStats", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("want 2 values, got %d", len(stats))
+	}
+	if s := stats[0]; s.Value != "pro" || s.Count != 2 || s.Failed != 0 {
+		t.Errorf("got top value %+v", s)
+	}
+	if s := stats[1]; s.Value != "free" || s.Count != 1 || s.Failed != 1 {
+		t.Errorf("got second value %+v", s)
+	}
+
+	if _, err := QueryTagStats(&CallQuery{}, ""); err == nil {
+		t.Error("want error for empty tag key")
+	}
+}
+
+func TestFinishCall_StoresTags(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	m := &Monitor{Store: defaultStore(), Live: &Hub{}}
+	c := &Call{HTTPMethod: "GET", RouteParams: Params{}, QueryParams: Params{}}
+	m.StartCall(c)
+	c.SetTag("plan", "pro")
+	m.FinishCall(c, CallStatus{HTTPStatusCode: 200})
+
+	c2 := getOnlyOneCall(t)
+	if want := (Params{"plan": "pro"}); !reflect.DeepEqual(c2.Tags, want) {
+		t.Errorf("got tags %v, want %v", c2.Tags, want)
+	}
+}
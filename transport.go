@@ -19,7 +19,7 @@ func (t TracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 
 	if t.ParentCallID != 0 {
 		r = cloneRequest(r)
-		addParentCallIDHeader(t.ParentCallID, r.Header)
+		InjectHeader(t.ParentCallID, r.Header)
 	}
 
 	return tr.RoundTrip(r)
@@ -0,0 +1,161 @@
+package appmon
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// TruncatedMarker is appended to call field values that were truncated
+// because they were too long to store.
+const TruncatedMarker = "…[truncated]"
+
+// Maximum lengths, in characters, of stored call fields. The app, host,
+// http_method and route limits are those of the database columns; the others
+// bound the size of call rows.
+const (
+	maxAppLength        = 24
+	maxHostLength       = 32
+	maxHTTPMethodLength = 12
+	maxRouteLength      = 64
+	maxURLLength        = 8192
+	maxUserAgentLength  = 1024
+	maxAddrChainLength  = 2048
+	maxParamValueLength = 1024
+	maxLogLineLength    = 4096
+)
+
+var truncations = struct {
+	sync.Mutex
+	n map[string]int64
+}{n: make(map[string]int64)}
+
+// Truncations returns the number of call field values that were truncated
+// because they were too long to store, by database column name (e.g., "url").
+func Truncations() map[string]int64 {
+	truncations.Lock()
+	defer truncations.Unlock()
+	m := make(map[string]int64, len(truncations.n))
+	for k, v := range truncations.n {
+		m[k] = v
+	}
+	return m
+}
+
+func countTruncation(column string) {
+	truncations.Lock()
+	defer truncations.Unlock()
+	if truncations.n[column] == 0 {
+		log.Printf("warning: truncated too-long value of call %s (further truncations are only counted; see appmon.Truncations)", column)
+	}
+	truncations.n[column]++
+}
+
+// truncate returns s, truncated to at most max characters (including
+// TruncatedMarker) if it's longer.
+func truncate(column, s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	countTruncation(column)
+	n := max - utf8.RuneCountInString(TruncatedMarker)
+	for i := range s {
+		if n == 0 {
+			return s[:i] + TruncatedMarker
+		}
+		n--
+	}
+	return s
+}
+
+// truncateParams returns p with string values longer than
+// maxParamValueLength truncated. If no values are truncated, p itself is
+// returned; otherwise p is not modified and a copy is returned.
+func truncateParams(column string, p Params) Params {
+	var t Params
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := truncateParamValue(column, p[k])
+		if v == nil {
+			continue
+		}
+		if t == nil {
+			t = make(Params, len(p))
+			for k, v := range p {
+				t[k] = v
+			}
+		}
+		t[k] = v
+	}
+	if t == nil {
+		return p
+	}
+	return t
+}
+
+// truncateParamValue returns the truncated version of v, or nil if v doesn't
+// need to be truncated. Param values are strings or lists of strings.
+func truncateParamValue(column string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if s := truncate(column, v, maxParamValueLength); s != v {
+			return s
+		}
+	case []string:
+		var t []string
+		for i, s := range v {
+			if ts := truncate(column, s, maxParamValueLength); ts != s {
+				if t == nil {
+					t = append([]string(nil), v...)
+				}
+				t[i] = ts
+			}
+		}
+		if t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// truncatedForDB returns a copy of c with field values that are too long to
+// store truncated.
+func truncatedForDB(c *Call) *Call {
+	t := *c
+	t.App = truncate("app", c.App, maxAppLength)
+	t.Host = truncate("host", c.Host, maxHostLength)
+	t.HTTPMethod = truncate("http_method", c.HTTPMethod, maxHTTPMethodLength)
+	t.Route = truncate("route", c.Route, maxRouteLength)
+	t.URL = truncate("url", c.URL, maxURLLength)
+	t.UserAgent = truncate("user_agent", c.UserAgent, maxUserAgentLength)
+	t.RemoteAddrChain = truncate("remote_addr_chain", c.RemoteAddrChain, maxAddrChainLength)
+	t.RouteParams = truncateParams("route_params", c.RouteParams)
+	t.QueryParams = truncateParams("query_params", c.QueryParams)
+	t.Tags = truncateParams("tags", c.Tags)
+	t.Log = truncateLines("log", c.Log)
+	return &t
+}
+
+// truncateLines returns lines with lines longer than maxLogLineLength
+// truncated. If no lines are truncated, lines itself is returned; otherwise
+// lines is not modified and a copy is returned.
+func truncateLines(column string, lines []string) []string {
+	var t []string
+	for i, s := range lines {
+		if ts := truncate(column, s, maxLogLineLength); ts != s {
+			if t == nil {
+				t = append([]string(nil), lines...)
+			}
+			t[i] = ts
+		}
+	}
+	if t == nil {
+		return lines
+	}
+	return t
+}
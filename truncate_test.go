@@ -0,0 +1,102 @@
+package appmon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"abc", 20, "abc"},
+		{strings.Repeat("a", 20), 20, strings.Repeat("a", 20)},
+		{strings.Repeat("a", 21), 20, strings.Repeat("a", 8) + TruncatedMarker},
+		{strings.Repeat("é", 30), 20, strings.Repeat("é", 8) + TruncatedMarker},
+	}
+	for _, test := range tests {
+		got := truncate("test", test.s, test.max)
+		if got != test.want {
+			t.Errorf("truncate(%q, %d): want %q, got %q", test.s, test.max, test.want, got)
+		}
+		if n := utf8.RuneCountInString(got); n > test.max {
+			t.Errorf("truncate(%q, %d): got %d characters", test.s, test.max, n)
+		}
+	}
+}
+
+func TestTruncatedForDB(t *testing.T) {
+	long := strings.Repeat("x", maxParamValueLength+1)
+	c := &Call{
+		App:             strings.Repeat("a", maxAppLength+1),
+		Host:            "example.com",
+		RemoteAddrChain: strings.Repeat("1.2.3.4, ", maxAddrChainLength),
+		URL:             "/" + strings.Repeat("u", maxURLLength),
+		RouteParams:     Params{"short": "v", "long": long},
+		QueryParams:     Params{"q": []string{"v", long}},
+	}
+	before := Truncations()
+
+	tc := truncatedForDB(c)
+	if tc.App != c.App[:maxAppLength-utf8.RuneCountInString(TruncatedMarker)]+TruncatedMarker {
+		t.Errorf("got App %q", tc.App)
+	}
+	if tc.Host != c.Host {
+		t.Errorf("got Host %q, want unchanged", tc.Host)
+	}
+	if n := utf8.RuneCountInString(tc.RemoteAddrChain); n != maxAddrChainLength {
+		t.Errorf("got RemoteAddrChain length %d, want %d", n, maxAddrChainLength)
+	}
+	if n := utf8.RuneCountInString(tc.URL); n != maxURLLength {
+		t.Errorf("got URL length %d, want %d", n, maxURLLength)
+	}
+	if v := tc.RouteParams["long"].(string); !strings.HasSuffix(v, TruncatedMarker) || tc.RouteParams["short"] != "v" {
+		t.Errorf("got RouteParams %v", tc.RouteParams)
+	}
+	if v := tc.QueryParams["q"].([]string); v[0] != "v" || !strings.HasSuffix(v[1], TruncatedMarker) {
+		t.Errorf("got QueryParams %v", tc.QueryParams)
+	}
+
+	// c must not be modified.
+	if c.RouteParams["long"] != long || !reflect.DeepEqual(c.QueryParams["q"], []string{"v", long}) {
+		t.Error("truncatedForDB modified the original call's params")
+	}
+
+	after := Truncations()
+	for _, column := range []string{"app", "remote_addr_chain", "url", "route_params", "query_params"} {
+		if after[column] != before[column]+1 {
+			t.Errorf("%s: want 1 truncation counted, got %d", column, after[column]-before[column])
+		}
+	}
+	if after["host"] != before["host"] {
+		t.Error("host: want no truncation counted")
+	}
+}
+
+func TestInsertCall_Truncated(t *testing.T) {
+	dbSetUp(t)
+	defer dbTearDown()
+
+	c := makeCall()
+	c.App = strings.Repeat("a", 100)
+	c.URL = "http://example.com/" + strings.Repeat("u", 2000)
+	c.UserAgent = strings.Repeat("b", 600)
+	if err := defaultStore().insertCall(c); err != nil {
+		t.Fatal("insertCall", err)
+	}
+
+	c2 := getOnlyOneCall(t)
+	if c2.App != truncate("app", c.App, maxAppLength) {
+		t.Errorf("got App %q", c2.App)
+	}
+	if c2.URL != c.URL {
+		t.Errorf("got URL %q, want %q", c2.URL, c.URL)
+	}
+	if c2.UserAgent != c.UserAgent {
+		t.Errorf("got UserAgent %q, want %q", c2.UserAgent, c.UserAgent)
+	}
+}
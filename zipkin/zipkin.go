@@ -0,0 +1,233 @@
+// Package zipkin exports appmon calls as Zipkin v2 spans.
+package zipkin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+	"github.com/sourcegraph/appmon/internal/export"
+)
+
+// DefaultEndpoint is the default span endpoint of a local Zipkin server.
+const DefaultEndpoint = "http://localhost:9411/api/v2/spans"
+
+// Options configures an Exporter.
+type Options struct {
+	// Endpoint is the URL that spans are POSTed to. If empty, DefaultEndpoint
+	// is used.
+	Endpoint string
+
+	// Client is the HTTP client used to send spans. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// Store is the Store that the exported calls are stored in. If nil, the
+	// Store of appmon.DefaultMonitor is assumed.
+	Store *appmon.Store
+
+	// Namespace identifies Store, and span and trace IDs are derived from it.
+	// If empty, export.DefaultNamespace(Store) is used (see
+	// github.com/sourcegraph/appmon/internal/export).
+	Namespace string
+
+	// Batching options. Zero values use the defaults in
+	// github.com/sourcegraph/appmon/internal/export.
+	MaxBatch      int
+	MaxQueue      int
+	FlushInterval time.Duration
+	MaxRetries    int
+}
+
+// Exporter is an appmon.Observer that batches finished calls and sends them to
+// a Zipkin server in the Zipkin v2 JSON format. Calls that arrive while
+// MaxQueue calls are waiting to be sent are dropped. Calls that weren't stored
+// (whose ID is 0) aren't exported.
+type Exporter struct {
+	opt     Options
+	traces  export.Traces
+	batcher *export.Batcher
+}
+
+// NewExporter creates an Exporter and starts its background sender. Callers
+// should add it to appmon.Observers and call Close on shutdown to send any
+// queued spans.
+func NewExporter(opt Options) *Exporter {
+	if opt.Endpoint == "" {
+		opt.Endpoint = DefaultEndpoint
+	}
+	if opt.Client == nil {
+		opt.Client = http.DefaultClient
+	}
+	if opt.Namespace == "" {
+		opt.Namespace = export.DefaultNamespace(opt.Store)
+	}
+	e := &Exporter{opt: opt}
+	e.traces.Namespace = opt.Namespace
+	e.batcher = &export.Batcher{
+		Name:          "Zipkin exporter",
+		Send:          e.send,
+		MaxBatch:      opt.MaxBatch,
+		MaxQueue:      opt.MaxQueue,
+		FlushInterval: opt.FlushInterval,
+		MaxRetries:    opt.MaxRetries,
+	}
+	e.batcher.Start()
+	return e
+}
+
+// CallStarted implements appmon.Observer.
+func (e *Exporter) CallStarted(c *appmon.Call) {
+	if c.ID == 0 {
+		return
+	}
+	e.traces.Start(c)
+}
+
+// CallFinished implements appmon.Observer.
+func (e *Exporter) CallFinished(c *appmon.Call) {
+	if c.ID == 0 {
+		return
+	}
+	e.batcher.Add(c)
+}
+
+// Dropped returns the number of spans that were dropped because the queue was
+// full or the Zipkin server couldn't be reached.
+func (e *Exporter) Dropped() int64 {
+	return e.batcher.Dropped()
+}
+
+// Close sends all queued spans.
+func (e *Exporter) Close() {
+	e.batcher.Close()
+}
+
+// Span is a span in the Zipkin v2 JSON format.
+type Span struct {
+	TraceID        string            `json:"traceId"`
+	ID             string            `json:"id"`
+	ParentID       string            `json:"parentId,omitempty"`
+	Name           string            `json:"name,omitempty"`
+	Kind           string            `json:"kind,omitempty"`
+	Timestamp      int64             `json:"timestamp"` // microseconds since the epoch
+	Duration       int64             `json:"duration"`  // microseconds
+	LocalEndpoint  *Endpoint         `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *Endpoint         `json:"remoteEndpoint,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+// Endpoint is a network endpoint in the Zipkin v2 JSON format.
+type Endpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+}
+
+func (e *Exporter) send(calls []*appmon.Call) error {
+	spans := make([]*Span, len(calls))
+	for i, c := range calls {
+		spans[i] = e.span(c)
+	}
+	body, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.opt.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.opt.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Zipkin server returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *Exporter) span(c *appmon.Call) *Span {
+	traceID, spanID := e.traces.TraceID(c), e.traces.SpanID(c.ID)
+	s := &Span{
+		TraceID:       hex.EncodeToString(traceID[:]),
+		ID:            hex.EncodeToString(spanID[:]),
+		Name:          c.Route,
+		Kind:          "SERVER",
+		Timestamp:     c.Start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(c.Duration() / time.Microsecond),
+		LocalEndpoint: &Endpoint{ServiceName: c.App},
+		Tags: map[string]string{
+			"appmon.call_id":   strconv.FormatInt(c.ID, 10),
+			"appmon.host":      c.Host,
+			"http.method":      c.HTTPMethod,
+			"http.url":         c.URL,
+			"http.status_code": strconv.Itoa(c.HTTPStatusCode),
+		},
+	}
+	if s.Name == "" {
+		s.Name = strings.ToLower(c.HTTPMethod)
+	}
+	if c.ParentCallID != 0 {
+		parentID := e.traces.SpanID(int64(c.ParentCallID))
+		s.ParentID = hex.EncodeToString(parentID[:])
+	}
+	remoteHost := c.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteHost); err == nil {
+		remoteHost = host
+	}
+	if ip := net.ParseIP(remoteHost); ip != nil {
+		if ip.To4() != nil {
+			s.RemoteEndpoint = &Endpoint{IPv4: ip.String()}
+		} else {
+			s.RemoteEndpoint = &Endpoint{IPv6: ip.String()}
+		}
+	}
+	if c.Err != "" {
+		s.Tags["error"] = string(c.Err)
+	} else if c.HTTPStatusCode >= 500 {
+		s.Tags["error"] = strconv.Itoa(c.HTTPStatusCode)
+	}
+	for k, v := range c.RouteParams {
+		s.Tags["appmon.route_params."+k] = paramString(v)
+	}
+	for k, v := range c.QueryParams {
+		s.Tags["appmon.query_params."+k] = paramString(v)
+	}
+	for k, v := range c.Tags {
+		s.Tags["appmon.tags."+k] = paramString(v)
+	}
+	return s
+}
+
+// paramString formats a parameter value as a tag value. Zipkin tag values are
+// strings, so multiple values are joined with commas.
+func paramString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, x := range v {
+			s[i] = fmt.Sprint(x)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v)
+}
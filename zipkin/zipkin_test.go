@@ -0,0 +1,142 @@
+package zipkin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/appmon"
+	"github.com/sourcegraph/go-nnz/nnz"
+)
+
+// collector is a fake Zipkin server that records the spans it receives.
+type collector struct {
+	mu    sync.Mutex
+	spans []*Span
+	posts int
+	fails int // number of requests to fail before accepting
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fails > 0 {
+		c.fails--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var spans []*Span
+	if err := json.NewDecoder(r.Body).Decode(&spans); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.posts++
+	c.spans = append(c.spans, spans...)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestExporter(t *testing.T) {
+	coll := &collector{fails: 2}
+	srv := httptest.NewServer(coll)
+	defer srv.Close()
+
+	e := NewExporter(Options{Endpoint: srv.URL, FlushInterval: time.Hour, MaxBatch: 2})
+	e.batcher.RetryBackoff = time.Millisecond
+
+	start := time.Unix(1400000000, 0)
+	parent := &appmon.Call{ID: 10, App: "web", Route: "home", HTTPMethod: "GET", RemoteAddr: "1.2.3.4", Start: start}
+	child := &appmon.Call{
+		ID:           11,
+		ParentCallID: nnz.Int64(10),
+		App:          "api",
+		HTTPMethod:   "GET",
+		RouteParams:  appmon.Params{"id": "123"},
+		QueryParams:  appmon.Params{"q": []interface{}{"a", "b"}},
+		Start:        start,
+		CallStatus:   appmon.CallStatus{End: appmon.NullTime{Time: start.Add(1500 * time.Microsecond), Valid: true}, HTTPStatusCode: 500},
+	}
+	other := &appmon.Call{ID: 12, App: "web", Start: start}
+	for _, c := range []*appmon.Call{parent, child, other} {
+		e.CallStarted(c)
+	}
+	for _, c := range []*appmon.Call{child, parent, other} {
+		e.CallFinished(c)
+	}
+	e.Close()
+
+	if want, got := 2, coll.posts; want != got {
+		t.Errorf("want %d posts, got %d", want, got)
+	}
+	if len(coll.spans) != 3 {
+		t.Fatalf("want 3 spans, got %d", len(coll.spans))
+	}
+	c, p := coll.spans[0], coll.spans[1]
+	if c.TraceID != p.TraceID || c.TraceID == coll.spans[2].TraceID {
+		t.Errorf("want both spans in trace of call 10, got %q and %q", c.TraceID, p.TraceID)
+	}
+	if want := e.traces.SpanID(10); p.ID != hex.EncodeToString(want[:]) || c.ParentID != p.ID {
+		t.Errorf("want parent span ID %q, got span ID %q and child's parent ID %q", want, p.ID, c.ParentID)
+	}
+	if c.Name != "get" || c.LocalEndpoint.ServiceName != "api" {
+		t.Errorf("bad child span name or service: %+v", c)
+	}
+	if c.Timestamp != 1400000000000000 || c.Duration != 1500 {
+		t.Errorf("want timestamp 1400000000000000 and duration 1500, got %d and %d", c.Timestamp, c.Duration)
+	}
+	if c.Tags["error"] != "500" || c.Tags["appmon.route_params.id"] != "123" || c.Tags["appmon.query_params.q"] != "a,b" {
+		t.Errorf("bad child span tags: %v", c.Tags)
+	}
+	if p.RemoteEndpoint == nil || p.RemoteEndpoint.IPv4 != "1.2.3.4" {
+		t.Errorf("want parent remote endpoint 1.2.3.4, got %+v", p.RemoteEndpoint)
+	}
+}
+
+func TestExporter_BoundedQueue(t *testing.T) {
+	coll := &collector{}
+	srv := httptest.NewServer(coll)
+	defer srv.Close()
+
+	e := NewExporter(Options{Endpoint: srv.URL, FlushInterval: time.Hour, MaxBatch: 10, MaxQueue: 3})
+	for i := int64(1); i <= 5; i++ {
+		c := &appmon.Call{ID: i, Start: time.Now()}
+		e.CallStarted(c)
+		e.CallFinished(c)
+	}
+	e.Close()
+
+	if want, got := int64(2), e.Dropped(); want != got {
+		t.Errorf("want %d dropped, got %d", want, got)
+	}
+	if want, got := 3, len(coll.spans); want != got {
+		t.Errorf("want %d spans sent, got %d", want, got)
+	}
+}
+
+func TestExporter_IDs(t *testing.T) {
+	coll := &collector{}
+	srv := httptest.NewServer(coll)
+	defer srv.Close()
+
+	// Calls with the same ID in different Stores are different spans, and
+	// unstored calls aren't exported.
+	for _, opt := range []Options{{Namespace: "db1"}, {Store: &appmon.Store{Schema: "other"}}} {
+		opt.Endpoint = srv.URL
+		e := NewExporter(opt)
+		for _, c := range []*appmon.Call{{ID: 1, Start: time.Now()}, {Start: time.Now()}} {
+			e.CallStarted(c)
+			e.CallFinished(c)
+		}
+		e.Close()
+	}
+
+	if len(coll.spans) != 2 {
+		t.Fatalf("want 2 spans, got %d", len(coll.spans))
+	}
+	if s1, s2 := coll.spans[0], coll.spans[1]; s1.ID == s2.ID || s1.TraceID == s2.TraceID {
+		t.Errorf("want different span and trace IDs in different namespaces, got %+v and %+v", s1, s2)
+	}
+}